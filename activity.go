@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hackclub/streambot/cache"
+	"github.com/hackclub/streambot/geo"
+	"github.com/hackclub/streambot/ws"
+	"github.com/ipinfo/go-ipinfo/ipinfo"
+)
+
+const (
+	ipInfoCacheSize = 10000
+	ipInfoCacheTTL  = 5 * time.Minute
+)
+
+// An activitySpec declares what goes into the ws.Activity for an event type.
+type activitySpec struct {
+	// needsUser drops events without a real user, eg. ones from slackbot.
+	needsUser bool
+
+	// needsChannel drops events outside public channels and looks up the
+	// channel's name.
+	needsChannel bool
+
+	// registersUser counts the event's user as active in its channel.
+	registersUser bool
+
+	// locations fills in From with the user's location and To with the
+	// locations of everyone active in the channel.
+	locations bool
+
+	// fill copies anything else the activity needs from the event.
+	fill func(ev Event, activity *ws.Activity)
+}
+
+// activitySpecs lists the event types that get more than just their type sent
+// to websocket clients.
+var activitySpecs = map[string]activitySpec{
+	eventMessage: {
+		needsUser:     true,
+		needsChannel:  true,
+		registersUser: true,
+		locations:     true,
+	},
+	eventTyping: {
+		needsUser:     true,
+		needsChannel:  true,
+		registersUser: true,
+		locations:     true,
+	},
+	eventReactionAdded: {
+		needsChannel: true,
+		fill: func(ev Event, activity *ws.Activity) {
+			activity.Reaction = ev.Reaction
+		},
+	},
+}
+
+// activityBuilder turns Events into the ws.Activity sent to websocket clients.
+type activityBuilder struct {
+	// How many invalid locations have been dropped. Accessed atomically, so
+	// it goes first to be 64-bit aligned.
+	invalidLocations uint64
+
+	metadata   *slackMetadata
+	config     Config
+	anonymizer *geo.Anonymizer
+
+	// users' IP info, so busy channels don't look everyone up every time
+	ipInfoCache *cache.LRU
+}
+
+// Build returns the activity for ev, or false if it shouldn't be sent at all.
+func (b *activityBuilder) Build(ev Event) (ws.Activity, bool) {
+	activity := ws.NewActivity(ev.Type, "")
+	if t, ok := slackTime(ev.Timestamp); ok {
+		activity.Timestamp = t
+		activity.SlackTimestamp = ev.Timestamp
+	}
+
+	spec, ok := activitySpecs[ev.Type]
+	if !ok {
+		return activity, true
+	}
+
+	if spec.needsUser && (ev.User == "USLACKBOT" || ev.User == "") {
+		return activity, false
+	}
+
+	if spec.needsChannel {
+		if ev.Channel == streamChannel {
+			return activity, false
+		}
+
+		// Ignore messages if not in a public channel
+		if !strings.HasPrefix(ev.Channel, "C") {
+			fmt.Println(ev.Channel, "ignoring because not public")
+			return activity, false
+		}
+
+		channel, err := b.metadata.Channel(ev.Channel)
+		if err != nil {
+			log.Println("Error getting channel info:", err)
+			return activity, false
+		}
+
+		activity.ChannelName = "#" + channel.Name
+	}
+
+	if spec.registersUser {
+		b.config.RegisterActiveUserInChannel(ev.Channel, ev.User)
+	}
+
+	if spec.locations {
+		b.addLocations(ev, &activity)
+	}
+
+	if spec.fill != nil {
+		spec.fill(ev, &activity)
+	}
+
+	return activity, true
+}
+
+// addLocations sets From to where ev's user is and To to where everyone
+// active in its channel is, leaving out anyone who's hidden their location.
+func (b *activityBuilder) addLocations(ev Event, activity *ws.Activity) {
+	userIds, err := b.config.GetActiveUsersInChannel(ev.Channel)
+	if err != nil {
+		log.Println("error getting active users in channel from DB:", err)
+	}
+
+	// everything is looked up in one go for the user and the channel
+	lookup := append([]string{ev.User}, userIds...)
+
+	active, err := b.config.LocationsActive(lookup)
+	if err != nil {
+		log.Println("error checking whether users' locations are hidden:", err)
+		return
+	}
+
+	visible := []string{}
+	for _, userId := range lookup {
+		if active[userId] {
+			visible = append(visible, userId)
+		}
+	}
+
+	infos := b.ipInfo(visible)
+
+	if !active[ev.User] {
+		fmt.Println("not showing location because", ev.User, "has hidden it")
+	} else if info, present := infos[ev.User]; !present {
+		log.Println("User's IP info not in DB.")
+	} else if p, ok := b.location(ev.User, info); ok {
+		activity.From = &p
+	}
+
+	if userIds == nil {
+		return
+	}
+
+	activeLocations := []geo.GeoPoint{}
+
+	for _, userId := range userIds {
+		if info, present := infos[userId]; present && active[userId] {
+			if p, ok := b.location(userId, info); ok {
+				activeLocations = append(activeLocations, p)
+			}
+		}
+	}
+
+	activity.To = activeLocations
+}
+
+// A cachedIPInfo remembers whether we know a user's IP info, so users we
+// don't aren't looked up every time either.
+type cachedIPInfo struct {
+	info    ipinfo.Info
+	present bool
+}
+
+// ipInfo looks up the IP info of users, from the cache where it can and in
+// one batch from Config for the rest. Users whose info isn't known are left
+// out.
+func (b *activityBuilder) ipInfo(userIds []string) map[string]ipinfo.Info {
+	infos := map[string]ipinfo.Info{}
+
+	missing := []string{}
+	for _, userId := range userIds {
+		if cached, ok := b.ipInfoCache.Get(userId); ok {
+			if c := cached.(cachedIPInfo); c.present {
+				infos[userId] = c.info
+			}
+			continue
+		}
+
+		missing = append(missing, userId)
+	}
+
+	if len(missing) == 0 {
+		return infos
+	}
+
+	found, err := b.config.GetUsersIPInfo(missing)
+	if err != nil {
+		log.Println("error getting users' IP info:", err)
+		return infos
+	}
+
+	for _, userId := range missing {
+		info, present := found[userId]
+		b.ipInfoCache.Add(userId, cachedIPInfo{info: info, present: present})
+
+		if present {
+			infos[userId] = info
+		}
+	}
+
+	return infos
+}
+
+// InvalidLocations returns how many locations have been dropped for not parsing.
+func (b *activityBuilder) InvalidLocations() uint64 {
+	return atomic.LoadUint64(&b.invalidLocations)
+}
+
+// locationStatsHandler serves how many invalid locations b has dropped as
+// JSON, so bad IP info shows up somewhere other than the logs.
+func locationStatsHandler(b *activityBuilder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]uint64{
+			"invalid": b.InvalidLocations(),
+		})
+	})
+}
+
+// location works out where to show a user from their IP info, anonymized.
+// Invalid locations are dropped and counted rather than sent to clients.
+func (b *activityBuilder) location(userId string, info ipinfo.Info) (geo.GeoPoint, bool) {
+	p, err := geo.Parse(info.Location)
+	if err != nil {
+		n := atomic.AddUint64(&b.invalidLocations, 1)
+		log.Printf("dropping location for %s: %v (%d dropped so far)", userId, err, n)
+		return geo.GeoPoint{}, false
+	}
+
+	city := ""
+	if info.City != "" {
+		city = strings.Join([]string{info.City, info.Region, info.Country}, ", ")
+	}
+
+	return b.anonymizer.Anonymize(userId, p, city)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hackclub/streambot/cache"
+	"github.com/hackclub/streambot/geo"
+	"github.com/hackclub/streambot/util"
+	"github.com/hackclub/streambot/ws"
+	"github.com/slack-go/slack"
+)
+
+// A broadcaster sends activity to everyone watching the stream. *ws.Server is
+// the real one.
+type broadcaster interface {
+	Broadcast(activity ws.Activity)
+}
+
+// bot is streambot's event pipeline: it decides what to do with each Event,
+// whether that's answering a command, reposting to the stream channel, or
+// sending activity to websocket clients.
+type bot struct {
+	api        *slackClient
+	metadata   *slackMetadata
+	config     Config
+	server     broadcaster
+	commands   *commandRouter
+	activities *activityBuilder
+	typing     *typingStatus
+	botUserID  string
+
+	// inOrder runs what each event starts before moving on to the next event,
+	// instead of in the background. Slower, but it means a replay does the
+	// same thing every time.
+	inOrder bool
+
+	// everything handling an event started, so Run can wait for it
+	wg sync.WaitGroup
+}
+
+func newBot(api *slackClient, config Config, server broadcaster, anonymizer *geo.Anonymizer, botUserID string) *bot {
+	metadata := newSlackMetadata(api)
+
+	return &bot{
+		api:       api,
+		metadata:  metadata,
+		config:    config,
+		server:    server,
+		commands:  streambotCommands(config),
+		botUserID: botUserID,
+		typing:    newTypingStatus(api, metadata, streamChannel),
+
+		activities: &activityBuilder{
+			metadata:    metadata,
+			config:      config,
+			anonymizer:  anonymizer,
+			ipInfoCache: cache.NewLRU(ipInfoCacheSize, ipInfoCacheTTL),
+		},
+	}
+}
+
+// Run handles events from source until it runs out of them, then waits for
+// any work they started to finish.
+func (b *bot) Run(source EventSource) {
+	go b.typing.Run()
+
+	for ev := range source.Events() {
+		fmt.Println("Event Received:", ev.Type)
+
+		b.handle(ev)
+	}
+
+	b.wg.Wait()
+	b.typing.Stop()
+}
+
+// goHandle runs f in the background, tracked so Run can wait for it, or
+// right away if b handles events in order.
+func (b *bot) goHandle(f func()) {
+	if b.inOrder {
+		f()
+		return
+	}
+
+	b.wg.Add(1)
+
+	go func() {
+		defer b.wg.Done()
+		f()
+	}()
+}
+
+func (b *bot) handle(ev Event) {
+	b.goHandle(func() {
+		b.broadcastActivity(ev)
+	})
+
+	switch ev.Type {
+	case eventMessage:
+		if ev.User == "USLACKBOT" || ev.User == "" || ev.User == b.botUserID || ev.Channel == streamChannel {
+			return
+		}
+
+		if args, ok := parseCommand(b.botUserID, ev.Channel, ev.Text); ok {
+			reply := b.commands.Dispatch(commandRequest{
+				User:    ev.User,
+				Channel: ev.Channel,
+				Args:    args,
+				Source:  strings.Join(args, " "),
+			})
+
+			b.goHandle(func() {
+				sendMessage(b.api, ev.Channel, reply)
+			})
+			return
+		}
+
+		// Ignore messages if not in a public channel
+		if !strings.HasPrefix(ev.Channel, "C") {
+			fmt.Println(ev.Channel, "ignoring because not public")
+			return
+		}
+
+		if !b.config.ChannelActive(ev.Channel) {
+			fmt.Println("ignoring message because", ev.Channel, "is set to ignore")
+			return
+		}
+
+		if !b.config.UserActive(ev.User) {
+			fmt.Println("ignoring message because", ev.User, "is set to ignore")
+			return
+		}
+
+		fmt.Println(ev.Text)
+
+		b.goHandle(func() {
+			streamMsg(b.api, b.metadata, ev)
+		})
+	case eventTyping:
+		if !b.config.ChannelActive(ev.Channel) {
+			fmt.Println("ignoring typing because", ev.Channel, "is set to ignore")
+			return
+		}
+
+		if !b.config.UserActive(ev.User) {
+			fmt.Println("ignoring typing because", ev.User, "is set to ignore")
+			return
+		}
+
+		b.goHandle(func() {
+			if err := b.typing.Add(ev); err != nil {
+				log.Println("error streaming typing:", err)
+			}
+		})
+	case eventMemberJoinedChannel:
+		if ev.Channel == streamChannel {
+			attachment := slack.Attachment{
+				Color:    "#0040FF",
+				ImageURL: "https://i.imgur.com/4m3Rra5.gif",
+			}
+
+			b.goHandle(func() {
+				_, err := b.api.PostEphemeral(streamChannel, ev.User, slack.MsgOptionAttachments(attachment), slack.MsgOptionAsUser(true))
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			})
+		}
+	case eventChannelJoined:
+		fmt.Println(ev.Channel)
+
+		b.goHandle(func() {
+			sendMessage(b.api, ev.Channel, introMessage())
+		})
+	case eventChannelRename, eventChannelArchive:
+		b.metadata.InvalidateChannel(ev.Channel)
+	case eventUserChange:
+		b.metadata.InvalidateUser(ev.User)
+	case eventChannelCreated:
+		if !joinNewChannels || util.Contains(ignoreChannelsCreatedByUserIds, ev.User) {
+			return
+		}
+
+		fmt.Println("joining new channel", ev.ChannelName)
+
+		b.goHandle(func() {
+			if _, err := b.api.JoinChannel(ev.ChannelName); err != nil {
+				log.Println("error joining new channel:", err)
+			}
+		})
+	}
+}
+
+// broadcastActivity sends what happened in ev to websocket clients.
+func (b *bot) broadcastActivity(ev Event) {
+	activity, ok := b.activities.Build(ev)
+	if !ok {
+		return
+	}
+
+	// log message type to ws
+	b.server.Broadcast(activity)
+}
+
+// introMessage is what streambot says when it joins a channel.
+func introMessage() string {
+	return `:wave: hi! i'm a bot built by <@zrl> that streams channel activity to <#` + streamChannel + `> so people can easily discover new channels.
+
+don't want your channel (or your account) to be part of this? that's ok! just type ` + "`" + `<@streambot> disable me` + "`" + ` to have me ignore all of your messages or ` + "`" + `<@streambot> disable channel` + "`" + ` to have me ignore this whole channel.
+
+if you want to re-enable streaming, you can type ` + "`" + `<@streambot> enable me` + "`" + ` or ` + "`" + `<@streambot> enable channel` + "`" + ` and if you want to check whether i'm streaming, you can type ` + "`" + `<@streambot> status me` + "`" + ` or ` + "`" + `<@streambot> status channel` + "`" + `.
+
+your approximate location is shown on the stream's map unless you've disabled streaming for yourself. you can hide it on its own with ` + "`" + `<@streambot> location off` + "`" + `.
+
+i'll never stream private messages, group chats, or private channels. message <@zrl> if you have any questions. happy hacking!`
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hackclub/streambot/geo"
+	"github.com/hackclub/streambot/slackfake"
+	"github.com/hackclub/streambot/ws"
+	"github.com/slack-go/slack"
+)
+
+const testStreamChannel = "CSTREAM01"
+
+// recordingBroadcaster keeps everything broadcast to it.
+type recordingBroadcaster struct {
+	mu         sync.Mutex
+	activities []ws.Activity
+}
+
+func (r *recordingBroadcaster) Broadcast(activity ws.Activity) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.activities = append(r.activities, activity)
+}
+
+func (r *recordingBroadcaster) types() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	types := []string{}
+	for _, activity := range r.activities {
+		types = append(types, activity.Type)
+	}
+
+	return types
+}
+
+// newTestBot makes a bot that handles events in order, talking to a fake
+// Slack with a couple of users and channels and keeping state in memory.
+func newTestBot(t *testing.T) (*bot, *slackfake.Server, *recordingBroadcaster) {
+	oldStreamChannel := streamChannel
+	t.Cleanup(func() { streamChannel = oldStreamChannel })
+	streamChannel = testStreamChannel
+
+	fastRateLimits(t)
+
+	fake := slackfake.New()
+	t.Cleanup(fake.Close)
+
+	users := map[string]string{"UALICE001": "alice", "UBOB00001": "bob"}
+	for id, name := range users {
+		user := slack.User{ID: id, Name: name}
+		user.Profile.DisplayName = name
+		fake.AddUser(user)
+	}
+
+	channels := map[string]string{"CGENERAL1": "general", "CRANDOM01": "random", testStreamChannel: "stream"}
+	for id, name := range channels {
+		channel := slack.Channel{}
+		channel.ID = id
+		channel.Name = name
+		fake.AddChannel(channel)
+	}
+
+	anonymizer, err := geo.NewAnonymizer(geo.AnonymizerOptions{Snap: geo.SnapOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &recordingBroadcaster{}
+	api := newSlackClient(slack.New("xoxb-test", slack.OptionAPIURL(fake.URL)))
+
+	b := newBot(api, NewMemoryConfig(time.Hour), server, anonymizer, "UBOT")
+	b.inOrder = true
+
+	return b, fake, server
+}
+
+func TestReplay(t *testing.T) {
+	b, fake, server := newTestBot(t)
+
+	source, err := newReplayEventSource("testdata/replay.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Run(source)
+
+	streamed := fake.PostedMessages(testStreamChannel)
+	if len(streamed) != 1 {
+		t.Fatalf("streamed %d messages, want 1: %v", len(streamed), streamed)
+	}
+	if attachments := streamed[0].Get("attachments"); !strings.Contains(attachments, "hello world") {
+		t.Errorf("streamed %s, want alice's message", attachments)
+	}
+
+	replies := fake.PostedMessages("CGENERAL1")
+	if len(replies) != 1 || replies[0].Get("text") != "i will now ignore your messages" {
+		t.Errorf("replied %v in #general, want the disable me reply", replies)
+	}
+
+	intros := fake.PostedMessages("CRANDOM01")
+	if len(intros) != 1 || !strings.Contains(intros[0].Get("text"), "hi! i'm a bot") {
+		t.Errorf("said %v in #random, want the intro", intros)
+	}
+
+	want := []string{eventMessage, eventMessage, eventMessage, eventReactionAdded, eventChannelJoined}
+	if got := server.types(); !reflect.DeepEqual(got, want) {
+		t.Errorf("broadcast %v, want %v", got, want)
+	}
+}
+
+func TestJoinNewChannels(t *testing.T) {
+	for _, join := range []bool{false, true} {
+		b, fake, _ := newTestBot(t)
+
+		old := joinNewChannels
+		joinNewChannels = join
+
+		b.handle(Event{Type: eventChannelCreated, User: "UALICE001", Channel: "CNEW00001", ChannelName: "new"})
+
+		joinNewChannels = old
+
+		want := 0
+		if join {
+			want = 1
+		}
+
+		if got := len(fake.Requests("channels.join")); got != want {
+			t.Errorf("with joinNewChannels %v, joined %d channels, want %d", join, got, want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package cache
+
+import "sync"
+
+// Group makes sure there's only one lookup of each key in flight at a time.
+// Anyone asking for a key that's already being looked up waits for that lookup
+// and gets its result.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+// Do runs lookup for key, unless it's already running, and returns what it
+// returned.
+func (g *Group) Do(key string, lookup func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.value, c.err
+	}
+
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.value, c.err = lookup()
+	c.wg.Done()
+
+	g.mu.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+
+	return c.value, c.err
+}
+
+// Forget makes the next Do for key start a new lookup instead of waiting for
+// one already running, eg. because what it's looking up has just changed.
+func (g *Group) Forget(key string) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// A commandRequest is a command someone sent to streambot, whichever way it
+// reached us.
+type commandRequest struct {
+	User    string
+	Channel string
+	Args    []string
+
+	// Source is how the command was sent, eg. "disable channel" or
+	// "/streambot disable channel". It's recorded in the opt-out history.
+	Source string
+}
+
+// A commandHandler carries out a command and returns the reply to send back,
+// or an empty string if it was used wrong. args does not include the command
+// name.
+type commandHandler func(req commandRequest, args []string) string
+
+type command struct {
+	usage       string
+	description string
+	handler     commandHandler
+}
+
+// commandRouter dispatches commands to the handler registered for their first
+// argument.
+type commandRouter struct {
+	commands map[string]command
+}
+
+func newCommandRouter() *commandRouter {
+	return &commandRouter{
+		commands: map[string]command{},
+	}
+}
+
+// Register adds a command. usage is shown to people who get the arguments
+// wrong, description is shown in the help listing.
+func (r *commandRouter) Register(name, usage, description string, handler commandHandler) {
+	r.commands[name] = command{
+		usage:       usage,
+		description: description,
+		handler:     handler,
+	}
+}
+
+// Dispatch runs the command in req and returns the reply. Unknown commands get
+// a list of the ones we do know.
+func (r *commandRouter) Dispatch(req commandRequest) string {
+	if len(req.Args) == 0 {
+		return r.Usage()
+	}
+
+	cmd, ok := r.commands[strings.ToLower(req.Args[0])]
+	if !ok {
+		return "i don't know how to `" + req.Args[0] + "`.\n\n" + r.Usage()
+	}
+
+	reply := cmd.handler(req, req.Args[1:])
+	if reply == "" {
+		return "usage: `" + cmd.usage + "`"
+	}
+
+	return reply
+}
+
+// Usage lists every registered command.
+func (r *commandRouter) Usage() string {
+	names := make([]string, 0, len(r.commands))
+	for name := range r.commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	lines := []string{"here's what i can do:"}
+	for _, name := range names {
+		cmd := r.commands[name]
+		lines = append(lines, "• `"+cmd.usage+"`: "+cmd.description)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+var mentionRegexp = regexp.MustCompile(`^\s*<@([A-Z0-9]+)(\|[^>]*)?>:?`)
+
+// parseCommand pulls a command out of a Slack message. Only messages addressed
+// to the bot count: ones that start by mentioning it, or anything sent to it
+// in a DM.
+func parseCommand(botUserID, channel, text string) (args []string, ok bool) {
+	if match := mentionRegexp.FindStringSubmatch(text); match != nil {
+		if match[1] != botUserID {
+			return nil, false
+		}
+
+		text = text[len(match[0]):]
+	} else if !strings.HasPrefix(channel, "D") {
+		return nil, false
+	}
+
+	return tokenize(text), true
+}
+
+// tokenize splits s into whitespace separated arguments. Double quotes group
+// words into a single argument, and Slack's smart quotes are treated the same.
+func tokenize(s string) []string {
+	args := []string{}
+
+	var current strings.Builder
+	inArg, quoted := false, false
+
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '“' || r == '”':
+			quoted = !quoted
+			inArg = true
+		case unicode.IsSpace(r) && !quoted:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args
+}
+
+// streambotCommands builds the router for everything people can ask
+// streambot to do.
+func streambotCommands(config Config) *commandRouter {
+	r := newCommandRouter()
+
+	r.Register("status", "status me|channel", "check whether i'm streaming you or this channel",
+		targetCommand(func(req commandRequest, kind string) string {
+			if kind == optOutUser {
+				if config.UserActive(req.User) {
+					return "i am streaming your messages"
+				}
+				return "i am ignoring your messages"
+			}
+
+			if config.ChannelActive(req.Channel) {
+				return "i am streaming this channel's messages"
+			}
+			return "i am ignoring this channel's messages"
+		}))
+
+	r.Register("disable", "disable me|channel", "stop streaming you or this channel",
+		targetCommand(func(req commandRequest, kind string) string {
+			if kind == optOutUser {
+				config.DisableUser(req.User, req.User, req.Source)
+				return "i will now ignore your messages"
+			}
+
+			config.DisableChannel(req.Channel, req.User, req.Source)
+			return "i will now ignore this channel's messages"
+		}))
+
+	r.Register("enable", "enable me|channel", "start streaming you or this channel again",
+		targetCommand(func(req commandRequest, kind string) string {
+			if kind == optOutUser {
+				config.EnableUser(req.User, req.User, req.Source)
+				return "i will now stream your messages"
+			}
+
+			config.EnableChannel(req.Channel, req.User, req.Source)
+			return "i will now stream this channel's messages"
+		}))
+
+	history := targetCommand(func(req commandRequest, kind string) string {
+		if kind == optOutUser {
+			return optOutHistoryMessage(config, optOutUser, req.User)
+		}
+
+		return optOutHistoryMessage(config, optOutChannel, req.Channel)
+	})
+
+	r.Register("history", "history me|channel|location", "see who changed whether i stream you or this channel, or show your location, and when",
+		func(req commandRequest, args []string) string {
+			if len(args) == 1 && strings.ToLower(args[0]) == "location" {
+				return optOutHistoryMessage(config, optOutLocation, req.User)
+			}
+
+			return history(req, args)
+		})
+
+	r.Register("location", "location on|off|status", "show or hide where you are on the stream's map",
+		func(req commandRequest, args []string) string {
+			if len(args) != 1 {
+				return ""
+			}
+
+			switch strings.ToLower(args[0]) {
+			case "on":
+				config.EnableLocation(req.User, req.User, req.Source)
+				return "i will now show your approximate location"
+			case "off":
+				config.DisableLocation(req.User, req.User, req.Source)
+				return "i will now hide your location"
+			case "status":
+				if config.LocationActive(req.User) {
+					return "i am showing your approximate location"
+				}
+				if !config.UserActive(req.User) {
+					return "i am hiding your location because i'm ignoring your messages. use `location on` to show it anyway"
+				}
+				return "i am hiding your location"
+			default:
+				return ""
+			}
+		})
+
+	r.Register("help", "help", "show this message", func(commandRequest, []string) string {
+		return r.Usage()
+	})
+
+	return r
+}
+
+// targetCommand wraps handlers for commands that take "me" or "channel", and
+// shows usage for anything else.
+func targetCommand(handler func(req commandRequest, kind string) string) commandHandler {
+	return func(req commandRequest, args []string) string {
+		if len(args) != 1 {
+			return ""
+		}
+
+		switch strings.ToLower(args[0]) {
+		case "me":
+			return handler(req, optOutUser)
+		case "channel":
+			if !strings.HasPrefix(req.Channel, "C") {
+				return "that only works in a public channel"
+			}
+
+			return handler(req, optOutChannel)
+		default:
+			return ""
+		}
+	}
+}
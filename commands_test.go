@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{}},
+		{"   ", []string{}},
+		{"status", []string{"status"}},
+		{"  disable   me  ", []string{"disable", "me"}},
+		{"disable\tme\nnow", []string{"disable", "me", "now"}},
+		{`say "hello there" friend`, []string{"say", "hello there", "friend"}},
+		{"say “hello there” friend", []string{"say", "hello there", "friend"}},
+		{`say ""`, []string{"say", ""}},
+		{`say "unterminated quote`, []string{"say", "unterminated quote"}},
+		{`a"b c"d`, []string{"ab cd"}},
+	}
+
+	for _, test := range tests {
+		got := tokenize(test.in)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	const bot = "UBOT12345"
+
+	tests := []struct {
+		name    string
+		channel string
+		text    string
+		want    []string
+		wantOk  bool
+	}{
+		{"mention", "C12345678", "<@UBOT12345> status me", []string{"status", "me"}, true},
+		{"mention with colon", "C12345678", "<@UBOT12345>: disable channel", []string{"disable", "channel"}, true},
+		{"mention with name", "C12345678", "<@UBOT12345|streambot> help", []string{"help"}, true},
+		{"leading space", "C12345678", "  <@UBOT12345> help", []string{"help"}, true},
+		{"mention only", "C12345678", "<@UBOT12345>", []string{}, true},
+		{"other user", "C12345678", "<@UOTHER123> status me", nil, false},
+		{"no mention in channel", "C12345678", "status me", nil, false},
+		{"mention later in channel", "C12345678", "hey <@UBOT12345> status", nil, false},
+		{"dm", "D12345678", "status me", []string{"status", "me"}, true},
+		{"dm with mention", "D12345678", "<@UBOT12345> status me", []string{"status", "me"}, true},
+		{"dm mentioning someone else", "D12345678", "<@UOTHER123> status", nil, false},
+	}
+
+	for _, test := range tests {
+		got, ok := parseCommand(bot, test.channel, test.text)
+		if ok != test.wantOk || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseCommand(%q, %q) = %q, %v, want %q, %v", test.name, test.channel, test.text, got, ok, test.want, test.wantOk)
+		}
+	}
+}
+
+func TestHistoryLocation(t *testing.T) {
+	config := NewMemoryConfig(time.Hour)
+	commands := streambotCommands(config)
+
+	dispatch := func(source string) string {
+		return commands.Dispatch(commandRequest{User: "UALICE001", Channel: "DALICE001", Args: tokenize(source), Source: source})
+	}
+
+	if got, want := dispatch("history location"), "nobody has changed whether i show your location"; got != want {
+		t.Errorf("history location = %q, want %q", got, want)
+	}
+
+	dispatch("location off")
+
+	got := dispatch("history location")
+	if !strings.Contains(got, "<@UALICE001> disabled location sharing with `location off`") {
+		t.Errorf("history location = %q, want it to list location off", got)
+	}
+
+	if got := dispatch("history me"); got != "nobody has changed whether i stream you" {
+		t.Errorf("history me = %q, want no streaming changes", got)
+	}
+}
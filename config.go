@@ -1,113 +1,110 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"log"
+	"time"
 
-	"github.com/go-redis/redis"
 	"github.com/ipinfo/go-ipinfo/ipinfo"
 )
 
-type Config struct {
-	db *redis.Client
-}
-
-func NewConfig(redisURL string) (Config, error) {
-	opts, err := redis.ParseURL(redisURL)
-	if err != nil {
-		return Config{}, err
-	}
-
-	client := redis.NewClient(opts)
+const (
+	optOutUser     = "user"
+	optOutChannel  = "channel"
+	optOutLocation = "location"
 
-	return Config{
-		db: client,
-	}, nil
-}
-
-func (c *Config) UserActive(id string) bool {
-	if err := c.db.Get(id).Err(); err != nil {
-		if err == redis.Nil {
-			return true
-		}
-	}
-
-	return false
-}
+	// how many opt-out changes are kept per user or channel
+	maxOptOutHistory = 50
 
-func (c *Config) EnableUser(id string) {
-	c.db.Del(id)
+	// how long after they were last seen users stop counting as active in a
+	// channel, unless NewConfig is told otherwise
+	defaultActiveWindow = time.Hour
 
-}
-
-func (c *Config) DisableUser(id string) {
-	c.db.Set(id, true, 0)
-}
-
-func (c *Config) ChannelActive(id string) bool {
-	if err := c.db.Get(id).Err(); err != nil {
-		if err == redis.Nil {
-			return true
-		}
-	}
-
-	return false
-}
-
-func (c *Config) EnableChannel(id string) {
-	c.db.Del(id)
-}
+	// what to set REDIS_URL to to keep state in memory instead of Redis
+	memoryConfigURL = "memory"
+)
 
-func (c *Config) DisableChannel(id string) {
-	c.db.Set(id, true, 0)
+// An OptOutChange records someone enabling or disabling streaming for a user
+// or channel, or showing a user's location.
+type OptOutChange struct {
+	Kind      string    `json:"kind"`
+	Target    string    `json:"target"`
+	Enabled   bool      `json:"enabled"`
+	Actor     string    `json:"actor"`
+	Source    string    `json:"source"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
-func (c *Config) StoreIPInfo(info ipinfo.Info) error {
-	encoded, err := json.Marshal(info)
-	if err != nil {
-		fmt.Println("failed to write IP info to redis:", err)
-		return err
-	}
-
-	c.db.Set("ip/"+info.IP.String(), encoded, 0)
-
-	return nil
+// Config is where streambot keeps its state: who has opted out of streaming,
+// what we know about users' IPs, and who has been active in which channel.
+type Config interface {
+	UserActive(id string) bool
+	EnableUser(id, actor, source string)
+	DisableUser(id, actor, source string)
+	DisabledUsers() ([]string, error)
+
+	ChannelActive(id string) bool
+	EnableChannel(id, actor, source string)
+	DisableChannel(id, actor, source string)
+	DisabledChannels() ([]string, error)
+
+	// LocationActive reports whether a user's location may be shown. Until
+	// they choose with EnableLocation or DisableLocation it follows
+	// UserActive, so opting out of streaming hides their location too.
+	LocationActive(id string) bool
+	EnableLocation(id, actor, source string)
+	DisableLocation(id, actor, source string)
+
+	// LocationsActive is LocationActive for many users at once.
+	LocationsActive(ids []string) (map[string]bool, error)
+
+	// OptOutHistory returns up to limit of the most recent changes of the
+	// given kind to a user or channel, newest first. A limit of 0 or less
+	// returns nothing.
+	OptOutHistory(kind, target string, limit int) ([]OptOutChange, error)
+
+	StoreIPInfo(info ipinfo.Info) error
+	GetIPInfo(ip string) (info ipinfo.Info, present bool, err error)
+
+	StoreUserIP(userId, ip string)
+	GetUserIP(userId string) (ip string, present bool, err error)
+	GetUserIPInfo(userId string) (info ipinfo.Info, present bool, err error)
+
+	// GetUsersIPInfo is GetUserIPInfo for many users at once. Users whose
+	// IP info isn't known are left out.
+	GetUsersIPInfo(userIds []string) (map[string]ipinfo.Info, error)
+
+	// RegisterActiveUserInChannel marks a user as active in a channel now.
+	// GetActiveUsersInChannel returns the users active in the last
+	// activeWindow, forgetting the rest.
+	RegisterActiveUserInChannel(channelId, userId string)
+	GetActiveUsersInChannel(channelId string) ([]string, error)
 }
 
-func (c *Config) GetIPInfo(ip string) (info ipinfo.Info, present bool, err error) {
-	ipinfoStr, err := c.db.Get("ip/" + ip).Result()
-	if err == redis.Nil {
-		return info, false, nil
-	} else if err != nil {
-		fmt.Println("error getting IP info from DB:", err)
-		return info, present, err
-	}
-
-	if err := json.Unmarshal([]byte(ipinfoStr), &info); err != nil {
-		fmt.Println("error unmarshaling IP info gotten from DB:", err)
-		return info, present, err
+// NewConfig returns a Redis backed Config, or an in-memory one if redisURL is
+// memoryConfigURL. Users count as active in a channel for activeWindow after
+// they're last seen there, or an hour if it's 0.
+//
+// An empty redisURL is an error rather than meaning memory, so a missing
+// REDIS_URL in production doesn't quietly forget everyone's opt outs on the
+// next restart.
+func NewConfig(redisURL string, activeWindow time.Duration) (Config, error) {
+	if activeWindow <= 0 {
+		activeWindow = defaultActiveWindow
 	}
 
-	return info, true, nil
-}
-
-func (c *Config) StoreUserIP(userId, ip string) {
-	c.db.Set("userip/"+userId, ip, 0)
-}
-
-func (c *Config) GetUserIP(userId string) (ip string, present bool, err error) {
-	ip, err = c.db.Get("userip/" + userId).Result()
-	if err == redis.Nil {
-		return ip, false, nil
-	} else if err != nil {
-		fmt.Println("error getting user IP from DB:", err)
-		return ip, present, err
+	switch redisURL {
+	case "":
+		return nil, fmt.Errorf("no redis url, set it to %q to keep state in memory instead", memoryConfigURL)
+	case memoryConfigURL:
+		log.Println("WARNING: keeping state in memory, opt outs will be lost on restart")
+		return NewMemoryConfig(activeWindow), nil
 	}
 
-	return ip, true, nil
+	return NewRedisConfig(redisURL, activeWindow)
 }
 
-func (c *Config) GetUserIPInfo(userId string) (info ipinfo.Info, present bool, err error) {
+func getUserIPInfo(c Config, userId string) (info ipinfo.Info, present bool, err error) {
 	var ip string
 
 	ip, present, err = c.GetUserIP(userId)
@@ -121,11 +118,3 @@ func (c *Config) GetUserIPInfo(userId string) (info ipinfo.Info, present bool, e
 
 	return c.GetIPInfo(ip)
 }
-
-func (c *Config) RegisterActiveUserInChannel(channelId, userId string) {
-	c.db.SAdd("active_channel_members/"+channelId, userId)
-}
-
-func (c *Config) GetActiveUsersInChannel(channelId string) ([]string, error) {
-	return c.db.SMembers("active_channel_members/" + channelId).Result()
-}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipinfo/go-ipinfo/ipinfo"
+)
+
+// memoryConfig is a Config that only lives as long as the process. It's meant
+// for running streambot locally without Redis.
+type memoryConfig struct {
+	mu sync.Mutex
+
+	disabledUsers    map[string]bool
+	disabledChannels map[string]bool
+	locationSettings map[string]bool
+	optOutHistory    map[string][]OptOutChange
+	ipInfo           map[string]ipinfo.Info
+	userIPs          map[string]string
+	channelMembers   map[string]map[string]time.Time
+
+	activeWindow time.Duration
+}
+
+func NewMemoryConfig(activeWindow time.Duration) Config {
+	return &memoryConfig{
+		disabledUsers:    map[string]bool{},
+		disabledChannels: map[string]bool{},
+		locationSettings: map[string]bool{},
+		optOutHistory:    map[string][]OptOutChange{},
+		ipInfo:           map[string]ipinfo.Info{},
+		userIPs:          map[string]string{},
+		channelMembers:   map[string]map[string]time.Time{},
+		activeWindow:     activeWindow,
+	}
+}
+
+func (c *memoryConfig) UserActive(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.disabledUsers[id]
+}
+
+func (c *memoryConfig) EnableUser(id, actor, source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.disabledUsers, id)
+	c.recordOptOutChange(optOutUser, id, true, actor, source)
+}
+
+func (c *memoryConfig) DisableUser(id, actor, source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.disabledUsers[id] = true
+	c.recordOptOutChange(optOutUser, id, false, actor, source)
+}
+
+func (c *memoryConfig) DisabledUsers() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return sortedKeys(c.disabledUsers), nil
+}
+
+func (c *memoryConfig) ChannelActive(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.disabledChannels[id]
+}
+
+func (c *memoryConfig) EnableChannel(id, actor, source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.disabledChannels, id)
+	c.recordOptOutChange(optOutChannel, id, true, actor, source)
+}
+
+func (c *memoryConfig) DisableChannel(id, actor, source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.disabledChannels[id] = true
+	c.recordOptOutChange(optOutChannel, id, false, actor, source)
+}
+
+func (c *memoryConfig) DisabledChannels() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return sortedKeys(c.disabledChannels), nil
+}
+
+func (c *memoryConfig) LocationActive(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if enabled, ok := c.locationSettings[id]; ok {
+		return enabled
+	}
+
+	return !c.disabledUsers[id]
+}
+
+func (c *memoryConfig) LocationsActive(ids []string) (map[string]bool, error) {
+	active := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		active[id] = c.LocationActive(id)
+	}
+
+	return active, nil
+}
+
+func (c *memoryConfig) EnableLocation(id, actor, source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.locationSettings[id] = true
+	c.recordOptOutChange(optOutLocation, id, true, actor, source)
+}
+
+func (c *memoryConfig) DisableLocation(id, actor, source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.locationSettings[id] = false
+	c.recordOptOutChange(optOutLocation, id, false, actor, source)
+}
+
+// recordOptOutChange must be called with c.mu held.
+func (c *memoryConfig) recordOptOutChange(kind, target string, enabled bool, actor, source string) {
+	key := kind + "/" + target
+
+	history := append([]OptOutChange{{
+		Kind:      kind,
+		Target:    target,
+		Enabled:   enabled,
+		Actor:     actor,
+		Source:    source,
+		Timestamp: time.Now(),
+	}}, c.optOutHistory[key]...)
+
+	if len(history) > maxOptOutHistory {
+		history = history[:maxOptOutHistory]
+	}
+
+	c.optOutHistory[key] = history
+}
+
+func (c *memoryConfig) OptOutHistory(kind, target string, limit int) ([]OptOutChange, error) {
+	if limit <= 0 {
+		return []OptOutChange{}, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	history := c.optOutHistory[kind+"/"+target]
+	if len(history) > limit {
+		history = history[:limit]
+	}
+
+	return append([]OptOutChange{}, history...), nil
+}
+
+func (c *memoryConfig) StoreIPInfo(info ipinfo.Info) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ipInfo[info.IP.String()] = info
+
+	return nil
+}
+
+func (c *memoryConfig) GetIPInfo(ip string) (info ipinfo.Info, present bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, present = c.ipInfo[ip]
+
+	return info, present, nil
+}
+
+func (c *memoryConfig) StoreUserIP(userId, ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.userIPs[userId] = ip
+}
+
+func (c *memoryConfig) GetUserIP(userId string) (ip string, present bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ip, present = c.userIPs[userId]
+
+	return ip, present, nil
+}
+
+func (c *memoryConfig) GetUserIPInfo(userId string) (info ipinfo.Info, present bool, err error) {
+	return getUserIPInfo(c, userId)
+}
+
+func (c *memoryConfig) GetUsersIPInfo(userIds []string) (map[string]ipinfo.Info, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	infos := make(map[string]ipinfo.Info, len(userIds))
+	for _, userId := range userIds {
+		ip, ok := c.userIPs[userId]
+		if !ok {
+			continue
+		}
+
+		if info, ok := c.ipInfo[ip]; ok {
+			infos[userId] = info
+		}
+	}
+
+	return infos, nil
+}
+
+func (c *memoryConfig) RegisterActiveUserInChannel(channelId, userId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members, ok := c.channelMembers[channelId]
+	if !ok {
+		members = map[string]time.Time{}
+		c.channelMembers[channelId] = members
+	}
+
+	members[userId] = time.Now()
+	c.pruneChannelMembers(channelId)
+}
+
+func (c *memoryConfig) GetActiveUsersInChannel(channelId string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pruneChannelMembers(channelId)
+
+	active := map[string]bool{}
+	for userId := range c.channelMembers[channelId] {
+		active[userId] = true
+	}
+
+	return sortedKeys(active), nil
+}
+
+// pruneChannelMembers forgets users who haven't been active in a channel
+// within the window. It must be called with c.mu held.
+func (c *memoryConfig) pruneChannelMembers(channelId string) {
+	cutoff := time.Now().Add(-c.activeWindow)
+
+	for userId, seen := range c.channelMembers[channelId] {
+		if seen.Before(cutoff) {
+			delete(c.channelMembers[channelId], userId)
+		}
+	}
+
+	if len(c.channelMembers[channelId]) == 0 {
+		delete(c.channelMembers, channelId)
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
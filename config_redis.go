@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/ipinfo/go-ipinfo/ipinfo"
+)
+
+const (
+	disabledUsersKey    = "optout/users"
+	disabledChannelsKey = "optout/channels"
+
+	// hash of user ID to "on" or "off", for users who've chosen
+	locationSettingsKey = "optout/locations"
+
+	optOutMigrationKey       = "migrations/namespaced_optouts"
+	activeMemberMigrationKey = "migrations/scored_active_members"
+)
+
+// oldOptOutKey matches the bare Slack user and channel IDs opt-outs used to
+// be stored under.
+var oldOptOutKey = regexp.MustCompile(`^[UWCGD][A-Z0-9]{8,}$`)
+
+// redisConfig is a Config backed by a Redis database.
+type redisConfig struct {
+	db *redis.Client
+
+	activeWindow time.Duration
+}
+
+func NewRedisConfig(redisURL string, activeWindow time.Duration) (Config, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(opts)
+
+	c := &redisConfig{
+		db:           client,
+		activeWindow: activeWindow,
+	}
+
+	if err := c.migrateOptOuts(); err != nil {
+		return nil, fmt.Errorf("migrating opt-outs: %w", err)
+	}
+
+	if err := c.migrateActiveMembers(); err != nil {
+		return nil, fmt.Errorf("migrating active channel members: %w", err)
+	}
+
+	return c, nil
+}
+
+func (c *redisConfig) UserActive(id string) bool {
+	disabled, err := c.db.SIsMember(disabledUsersKey, id).Result()
+	if err != nil {
+		fmt.Println("error checking if user is disabled:", err)
+		return false
+	}
+
+	return !disabled
+}
+
+func (c *redisConfig) EnableUser(id, actor, source string) {
+	c.db.SRem(disabledUsersKey, id)
+	c.recordOptOutChange(optOutUser, id, true, actor, source)
+}
+
+func (c *redisConfig) DisableUser(id, actor, source string) {
+	c.db.SAdd(disabledUsersKey, id)
+	c.recordOptOutChange(optOutUser, id, false, actor, source)
+}
+
+func (c *redisConfig) DisabledUsers() ([]string, error) {
+	return c.sortedMembers(disabledUsersKey)
+}
+
+func (c *redisConfig) ChannelActive(id string) bool {
+	disabled, err := c.db.SIsMember(disabledChannelsKey, id).Result()
+	if err != nil {
+		fmt.Println("error checking if channel is disabled:", err)
+		return false
+	}
+
+	return !disabled
+}
+
+func (c *redisConfig) EnableChannel(id, actor, source string) {
+	c.db.SRem(disabledChannelsKey, id)
+	c.recordOptOutChange(optOutChannel, id, true, actor, source)
+}
+
+func (c *redisConfig) DisableChannel(id, actor, source string) {
+	c.db.SAdd(disabledChannelsKey, id)
+	c.recordOptOutChange(optOutChannel, id, false, actor, source)
+}
+
+func (c *redisConfig) DisabledChannels() ([]string, error) {
+	return c.sortedMembers(disabledChannelsKey)
+}
+
+func (c *redisConfig) LocationActive(id string) bool {
+	setting, err := c.db.HGet(locationSettingsKey, id).Result()
+	if err == redis.Nil {
+		return c.UserActive(id)
+	} else if err != nil {
+		fmt.Println("error checking if user's location is disabled:", err)
+		return false
+	}
+
+	return setting == "on"
+}
+
+// LocationsActive takes at most two round trips: one for everyone's location
+// settings, then one for the opt-outs of anyone without a setting.
+func (c *redisConfig) LocationsActive(ids []string) (map[string]bool, error) {
+	active := make(map[string]bool, len(ids))
+	if len(ids) == 0 {
+		return active, nil
+	}
+
+	settings, err := c.db.HMGet(locationSettingsKey, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	disabled := map[string]*redis.BoolCmd{}
+	if _, err := c.db.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			if setting, ok := settings[i].(string); ok {
+				active[id] = setting == "on"
+			} else {
+				disabled[id] = pipe.SIsMember(disabledUsersKey, id)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for id, cmd := range disabled {
+		active[id] = !cmd.Val()
+	}
+
+	return active, nil
+}
+
+func (c *redisConfig) EnableLocation(id, actor, source string) {
+	c.db.HSet(locationSettingsKey, id, "on")
+	c.recordOptOutChange(optOutLocation, id, true, actor, source)
+}
+
+func (c *redisConfig) DisableLocation(id, actor, source string) {
+	c.db.HSet(locationSettingsKey, id, "off")
+	c.recordOptOutChange(optOutLocation, id, false, actor, source)
+}
+
+func (c *redisConfig) recordOptOutChange(kind, target string, enabled bool, actor, source string) {
+	encoded, err := json.Marshal(OptOutChange{
+		Kind:      kind,
+		Target:    target,
+		Enabled:   enabled,
+		Actor:     actor,
+		Source:    source,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		fmt.Println("failed to encode opt-out change:", err)
+		return
+	}
+
+	key := optOutHistoryKey(kind, target)
+
+	if _, err := c.db.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.LPush(key, encoded)
+		pipe.LTrim(key, 0, maxOptOutHistory-1)
+		return nil
+	}); err != nil {
+		fmt.Println("failed to write opt-out change to redis:", err)
+	}
+}
+
+func (c *redisConfig) OptOutHistory(kind, target string, limit int) ([]OptOutChange, error) {
+	// LRANGE 0 -1 would be the whole list
+	if limit <= 0 {
+		return []OptOutChange{}, nil
+	}
+
+	encoded, err := c.db.LRange(optOutHistoryKey(kind, target), 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]OptOutChange, 0, len(encoded))
+	for _, e := range encoded {
+		var change OptOutChange
+		if err := json.Unmarshal([]byte(e), &change); err != nil {
+			fmt.Println("error unmarshaling opt-out change gotten from DB:", err)
+			continue
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
+func optOutHistoryKey(kind, target string) string {
+	return "optout_history/" + kind + "/" + target
+}
+
+func (c *redisConfig) sortedMembers(key string) ([]string, error) {
+	members, err := c.db.SMembers(key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(members)
+
+	return members, nil
+}
+
+// migrateOptOuts moves opt-outs from the old layout, where a disabled user or
+// channel was stored as a bare key named after its Slack ID, into the
+// namespaced sets. Moving a key is idempotent, so if this fails part way
+// through it just picks up where it left off next start. Once it's finished
+// it's marked done and never runs again.
+func (c *redisConfig) migrateOptOuts() error {
+	done, err := c.db.Exists(optOutMigrationKey).Result()
+	if err != nil {
+		return err
+	}
+
+	if done > 0 {
+		return nil
+	}
+
+	var keys []string
+
+	iter := c.db.Scan(0, "*", 1000).Iterator()
+	for iter.Next() {
+		key := iter.Val()
+
+		// every key streambot writes now has a prefix, so anything else that
+		// doesn't look like a Slack ID isn't ours to touch
+		if !oldOptOutKey.MatchString(key) {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		value, err := c.db.Get(key).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			fmt.Println("not migrating key", key+":", err)
+			continue
+		}
+
+		// old opt-outs were always set to true, which Redis stores as "1"
+		if value != "1" && value != "true" {
+			fmt.Println("not migrating key", key, "with unexpected value", value)
+			continue
+		}
+
+		set := disabledChannelsKey
+		if key[0] == 'U' || key[0] == 'W' {
+			set = disabledUsersKey
+		}
+
+		fmt.Println("migrating opt-out", key, "to", set)
+
+		if _, err := c.db.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.SAdd(set, key)
+			pipe.Del(key)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return c.db.Set(optOutMigrationKey, time.Now().Unix(), 0).Err()
+}
+
+// migrateActiveMembers deletes the old active channel member sets, which never
+// forgot anyone. Without timestamps there's no telling who in them is still
+// active, so they're dropped rather than moved. If it fails part way through
+// it finishes the job next start, and once it's done it never runs again.
+func (c *redisConfig) migrateActiveMembers() error {
+	done, err := c.db.Exists(activeMemberMigrationKey).Result()
+	if err != nil {
+		return err
+	}
+
+	if done > 0 {
+		return nil
+	}
+
+	iter := c.db.Scan(0, "active_channel_members/*", 1000).Iterator()
+	for iter.Next() {
+		fmt.Println("deleting old active channel members", iter.Val())
+
+		if err := c.db.Del(iter.Val()).Err(); err != nil {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	return c.db.Set(activeMemberMigrationKey, time.Now().Unix(), 0).Err()
+}
+
+func (c *redisConfig) StoreIPInfo(info ipinfo.Info) error {
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		fmt.Println("failed to write IP info to redis:", err)
+		return err
+	}
+
+	c.db.Set("ip/"+info.IP.String(), encoded, 0)
+
+	return nil
+}
+
+func (c *redisConfig) GetIPInfo(ip string) (info ipinfo.Info, present bool, err error) {
+	ipinfoStr, err := c.db.Get("ip/" + ip).Result()
+	if err == redis.Nil {
+		return info, false, nil
+	} else if err != nil {
+		fmt.Println("error getting IP info from DB:", err)
+		return info, present, err
+	}
+
+	if err := json.Unmarshal([]byte(ipinfoStr), &info); err != nil {
+		fmt.Println("error unmarshaling IP info gotten from DB:", err)
+		return info, present, err
+	}
+
+	return info, true, nil
+}
+
+func (c *redisConfig) StoreUserIP(userId, ip string) {
+	c.db.Set("userip/"+userId, ip, 0)
+}
+
+func (c *redisConfig) GetUserIP(userId string) (ip string, present bool, err error) {
+	ip, err = c.db.Get("userip/" + userId).Result()
+	if err == redis.Nil {
+		return ip, false, nil
+	} else if err != nil {
+		fmt.Println("error getting user IP from DB:", err)
+		return ip, present, err
+	}
+
+	return ip, true, nil
+}
+
+func (c *redisConfig) GetUserIPInfo(userId string) (info ipinfo.Info, present bool, err error) {
+	return getUserIPInfo(c, userId)
+}
+
+// GetUsersIPInfo takes two round trips however many users there are: one for
+// their IPs, then one for the info on those IPs.
+func (c *redisConfig) GetUsersIPInfo(userIds []string) (map[string]ipinfo.Info, error) {
+	infos := make(map[string]ipinfo.Info, len(userIds))
+	if len(userIds) == 0 {
+		return infos, nil
+	}
+
+	userIPKeys := make([]string, len(userIds))
+	for i, userId := range userIds {
+		userIPKeys[i] = "userip/" + userId
+	}
+
+	userIPs, err := c.db.MGet(userIPKeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ipUsers := map[string][]string{}
+	ipKeys := []string{}
+	for i, ip := range userIPs {
+		ip, ok := ip.(string)
+		if !ok {
+			continue
+		}
+
+		if _, seen := ipUsers[ip]; !seen {
+			ipKeys = append(ipKeys, "ip/"+ip)
+		}
+		ipUsers[ip] = append(ipUsers[ip], userIds[i])
+	}
+
+	if len(ipKeys) == 0 {
+		return infos, nil
+	}
+
+	encoded, err := c.db.MGet(ipKeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, e := range encoded {
+		e, ok := e.(string)
+		if !ok {
+			continue
+		}
+
+		var info ipinfo.Info
+		if err := json.Unmarshal([]byte(e), &info); err != nil {
+			fmt.Println("error unmarshaling IP info gotten from DB:", err)
+			continue
+		}
+
+		for _, userId := range ipUsers[strings.TrimPrefix(ipKeys[i], "ip/")] {
+			infos[userId] = info
+		}
+	}
+
+	return infos, nil
+}
+
+// Active channel members are kept in a sorted set per channel, scored by when
+// they were last seen. Anyone seen before the window is pruned whenever the
+// set is touched, and channels nobody's been active in for a whole window
+// expire altogether.
+func (c *redisConfig) RegisterActiveUserInChannel(channelId, userId string) {
+	key := activeMembersKey(channelId)
+	now := time.Now()
+
+	if _, err := c.db.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(key, redis.Z{Score: float64(now.Unix()), Member: userId})
+		pipe.ZRemRangeByScore(key, "-inf", c.activeCutoff(now))
+		pipe.Expire(key, c.activeWindow)
+		return nil
+	}); err != nil {
+		fmt.Println("error registering active user in channel:", err)
+	}
+}
+
+func (c *redisConfig) GetActiveUsersInChannel(channelId string) ([]string, error) {
+	key := activeMembersKey(channelId)
+
+	var members *redis.StringSliceCmd
+	if _, err := c.db.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(key, "-inf", c.activeCutoff(time.Now()))
+		members = pipe.ZRange(key, 0, -1)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return members.Val(), nil
+}
+
+// activeCutoff is the score below which members are no longer active, as an
+// exclusive bound.
+func (c *redisConfig) activeCutoff(now time.Time) string {
+	return "(" + strconv.FormatInt(now.Add(-c.activeWindow).Unix(), 10)
+}
+
+func activeMembersKey(channelId string) string {
+	return "active_members/" + channelId
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// testConfigs returns a Config for each backend to run the same test against.
+// The Redis one is only there if TEST_REDIS_URL points at a database that's
+// fine to scribble on.
+func testConfigs(t *testing.T, activeWindow time.Duration) map[string]Config {
+	configs := map[string]Config{
+		"memory": NewMemoryConfig(activeWindow),
+	}
+
+	if url := os.Getenv("TEST_REDIS_URL"); url != "" {
+		config, err := NewRedisConfig(url, activeWindow)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		configs["redis"] = config
+	}
+
+	return configs
+}
+
+func TestOptOutHistoryLimit(t *testing.T) {
+	for name, config := range testConfigs(t, time.Hour) {
+		target := "UHISTORY" + time.Now().Format("150405.000000")
+
+		config.DisableUser(target, target, "disable me")
+		config.EnableUser(target, target, "enable me")
+		config.DisableUser(target, target, "disable me")
+
+		tests := []struct {
+			limit int
+			want  int
+		}{
+			{-1, 0},
+			{0, 0},
+			{1, 1},
+			{2, 2},
+			{10, 3},
+		}
+
+		for _, test := range tests {
+			changes, err := config.OptOutHistory(optOutUser, target, test.limit)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			if len(changes) != test.want {
+				t.Errorf("%s: OptOutHistory with limit %d returned %d changes, want %d", name, test.limit, len(changes), test.want)
+			}
+		}
+
+		changes, _ := config.OptOutHistory(optOutUser, target, 1)
+		if len(changes) == 1 && (changes[0].Enabled || changes[0].Source != "disable me") {
+			t.Errorf("%s: newest change is %+v, want the last disable", name, changes[0])
+		}
+	}
+}
+
+func TestActiveUsersInChannelPruning(t *testing.T) {
+	config := NewMemoryConfig(100 * time.Millisecond)
+
+	config.RegisterActiveUserInChannel("CGENERAL1", "UALICE001")
+	time.Sleep(60 * time.Millisecond)
+	config.RegisterActiveUserInChannel("CGENERAL1", "UBOB00001")
+	config.RegisterActiveUserInChannel("CRANDOM01", "UALICE001")
+
+	if users, _ := config.GetActiveUsersInChannel("CGENERAL1"); !reflect.DeepEqual(users, []string{"UALICE001", "UBOB00001"}) {
+		t.Errorf("got %v active in general, want alice and bob", users)
+	}
+
+	// alice has gone quiet in general, but not in random
+	time.Sleep(60 * time.Millisecond)
+
+	if users, _ := config.GetActiveUsersInChannel("CGENERAL1"); !reflect.DeepEqual(users, []string{"UBOB00001"}) {
+		t.Errorf("got %v active in general, want just bob", users)
+	}
+
+	// saying something again makes her active again
+	config.RegisterActiveUserInChannel("CGENERAL1", "UALICE001")
+	if users, _ := config.GetActiveUsersInChannel("CGENERAL1"); !reflect.DeepEqual(users, []string{"UALICE001", "UBOB00001"}) {
+		t.Errorf("got %v active in general, want alice and bob", users)
+	}
+
+	time.Sleep(120 * time.Millisecond)
+
+	for _, channelId := range []string{"CGENERAL1", "CRANDOM01"} {
+		if users, _ := config.GetActiveUsersInChannel(channelId); len(users) != 0 {
+			t.Errorf("got %v active in %s after a whole window, want nobody", users, channelId)
+		}
+	}
+}
+
+// The old active member sets only ever lived in Redis, so the migration is
+// only tested when there's one to test against.
+func TestMigrateActiveMembers(t *testing.T) {
+	url := os.Getenv("TEST_REDIS_URL")
+	if url == "" {
+		t.Skip("TEST_REDIS_URL not set")
+	}
+
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := redis.NewClient(opts)
+	defer db.Close()
+
+	old := "active_channel_members/CMIGRATE1"
+	db.SAdd(old, "UALICE001", "UBOB00001")
+	db.Del(activeMemberMigrationKey)
+
+	config, err := NewRedisConfig(url, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, _ := db.Exists(old).Result(); exists != 0 {
+		t.Errorf("old active member set %s is still there", old)
+	}
+	if users, _ := config.GetActiveUsersInChannel("CMIGRATE1"); len(users) != 0 {
+		t.Errorf("got %v active after migrating, want nobody", users)
+	}
+
+	// once it's done, it doesn't run again
+	db.SAdd(old, "UALICE001")
+	if _, err := NewRedisConfig(url, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := db.Exists(old).Result(); exists != 1 {
+		t.Errorf("migration ran twice")
+	}
+	db.Del(old)
+}
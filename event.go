@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Event types streambot does something with. Everything else is still passed
+// along with just its Type set.
+const (
+	eventMessage             = "message"
+	eventTyping              = "user_typing"
+	eventReactionAdded       = "reaction_added"
+	eventMemberJoinedChannel = "member_joined_channel"
+	eventChannelJoined       = "channel_joined"
+	eventChannelCreated      = "channel_created"
+	eventChannelRename       = "channel_rename"
+	eventChannelArchive      = "channel_archive"
+	eventUserChange          = "user_change"
+)
+
+// An Event is something that happened in Slack, however Slack told us about
+// it. Which fields are set depends on Type.
+type Event struct {
+	Type string `json:"type"`
+
+	// User who did the thing. For channel_created it's the channel's creator.
+	User string `json:"user,omitempty"`
+
+	Channel     string `json:"channel,omitempty"`
+	ChannelName string `json:"channel_name,omitempty"`
+
+	Text     string `json:"text,omitempty"`
+	Reaction string `json:"reaction,omitempty"`
+
+	// Timestamp is Slack's timestamp for the event, eg. "1589910000.000200".
+	Timestamp string `json:"ts,omitempty"`
+}
+
+// An EventSource delivers events from Slack. The channel is closed when there
+// are no more.
+type EventSource interface {
+	Events() <-chan Event
+}
+
+// slackEventSource turns events in the form the slack package gives them to us
+// into Events. RTM, the Events API and Socket Mode all end up here.
+type slackEventSource struct {
+	events chan Event
+}
+
+func newSlackEventSource(incoming <-chan slack.RTMEvent) EventSource {
+	s := &slackEventSource{
+		events: make(chan Event),
+	}
+
+	go func() {
+		defer close(s.events)
+
+		for msg := range incoming {
+			s.events <- eventFromSlack(msg)
+		}
+	}()
+
+	return s
+}
+
+func (s *slackEventSource) Events() <-chan Event {
+	return s.events
+}
+
+func eventFromSlack(msg slack.RTMEvent) Event {
+	ev := Event{Type: msg.Type}
+
+	switch data := msg.Data.(type) {
+	case *slack.MessageEvent:
+		ev.User = data.User
+		ev.Channel = data.Channel
+		ev.Text = data.Text
+		ev.Timestamp = data.Timestamp
+	case *slack.UserTypingEvent:
+		ev.User = data.User
+		ev.Channel = data.Channel
+	case *slack.ReactionAddedEvent:
+		ev.User = data.User
+		ev.Channel = data.Item.Channel
+		ev.Reaction = data.Reaction
+		ev.Timestamp = data.EventTimestamp
+	case *slack.MemberJoinedChannelEvent:
+		ev.User = data.User
+		ev.Channel = data.Channel
+	case *slack.ChannelJoinedEvent:
+		ev.Channel = data.Channel.ID
+		ev.ChannelName = data.Channel.Name
+	case *slack.ChannelCreatedEvent:
+		ev.User = data.Channel.Creator
+		ev.Channel = data.Channel.ID
+		ev.ChannelName = data.Channel.Name
+		ev.Timestamp = data.EventTimestamp
+	case *slack.ChannelRenameEvent:
+		ev.Channel = data.Channel.ID
+		ev.ChannelName = data.Channel.Name
+		ev.Timestamp = data.Timestamp
+	case *slack.ChannelArchiveEvent:
+		ev.User = data.User
+		ev.Channel = data.Channel
+	case *slack.UserChangeEvent:
+		ev.User = data.User.ID
+	case *slack.RTMError:
+		fmt.Fprintln(os.Stderr, "Error:", data.Error())
+	}
+
+	return ev
+}
+
+// slackTime parses a Slack timestamp like "1589910000.000200", which is
+// seconds and microseconds since the epoch.
+func slackTime(ts string) (time.Time, bool) {
+	if ts == "" {
+		return time.Time{}, false
+	}
+
+	parts := strings.SplitN(ts, ".", 2)
+
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var usec int64
+	if len(parts) == 2 {
+		usec, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || len(parts[1]) != 6 {
+			return time.Time{}, false
+		}
+	}
+
+	return time.Unix(sec, usec*int64(time.Microsecond)), true
+}
+
+// replayEventSource plays back events recorded in a JSONL file, one Event per
+// line, so streambot can be run without Slack.
+type replayEventSource struct {
+	events chan Event
+}
+
+func newReplayEventSource(path string) (EventSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &replayEventSource{
+		events: make(chan Event),
+	}
+
+	go func() {
+		defer f.Close()
+		defer close(s.events)
+
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+
+			var ev Event
+			if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+				log.Printf("skipping bad event on line %d of %s: %v", line, path, err)
+				continue
+			}
+
+			s.events <- ev
+		}
+
+		if err := scanner.Err(); err != nil {
+			log.Println("error reading replay file:", err)
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *replayEventSource) Events() <-chan Event {
+	return s.events
+}
+
+// recordingEventSource passes events through from another source while
+// writing them to a JSONL file that a replayEventSource can play back.
+type recordingEventSource struct {
+	events chan Event
+}
+
+func newRecordingEventSource(source EventSource, path string) (EventSource, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &recordingEventSource{
+		events: make(chan Event),
+	}
+
+	enc := json.NewEncoder(f)
+
+	go func() {
+		defer f.Close()
+		defer close(s.events)
+
+		for ev := range source.Events() {
+			if err := enc.Encode(ev); err != nil {
+				log.Println("error recording event:", err)
+			}
+
+			s.events <- ev
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *recordingEventSource) Events() <-chan Event {
+	return s.events
+}
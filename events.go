@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/hackclub/streambot/cache"
+	"github.com/hackclub/streambot/util"
+	"github.com/slack-go/slack"
+)
+
+// The Events API event types streambot handles. The app should be subscribed
+// to these.
+var eventsAPITypes = []string{
+	"message",
+	"reaction_added",
+	"member_joined_channel",
+	"channel_created",
+	"channel_rename",
+	"channel_archive",
+	"user_change",
+}
+
+const (
+	// how many recent event IDs are remembered to spot retries. Slack gives
+	// up retrying after about half an hour, and we get nowhere near this many
+	// events in that time.
+	seenEventsSize = 10000
+	seenEventsTTL  = time.Hour
+)
+
+// eventsAPIHandler receives events from Slack's Events API and sends them on
+// events in the same form RTM delivers them, so the same code can handle both.
+func eventsAPIHandler(signingSecret, botUserID string, events chan<- slack.RTMEvent) http.Handler {
+	var seenMu sync.Mutex
+	seen := cache.NewLRU(seenEventsSize, seenEventsTTL)
+
+	// firstDelivery reports whether the event with id hasn't come in before,
+	// and remembers that it has now
+	firstDelivery := func(id string) bool {
+		if id == "" {
+			return true
+		}
+
+		seenMu.Lock()
+		defer seenMu.Unlock()
+
+		if _, ok := seen.Get(id); ok {
+			return false
+		}
+
+		seen.Add(id, true)
+
+		return true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := verifySlackRequest(signingSecret, r)
+		if err != nil {
+			log.Println("rejecting events api request:", err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var outer struct {
+			Type      string          `json:"type"`
+			Challenge string          `json:"challenge"`
+			EventID   string          `json:"event_id"`
+			Event     json.RawMessage `json:"event"`
+		}
+		if err := json.Unmarshal(body, &outer); err != nil {
+			log.Println("error parsing events api request:", err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		switch outer.Type {
+		case "url_verification":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(outer.Challenge))
+			return
+		case "event_callback":
+			// Slack retries events it thinks we didn't get. If we did,
+			// we were just slow to say so, but if the first try never made
+			// it here the retry is all we'll get.
+			if !firstDelivery(outer.EventID) {
+				log.Println("ignoring events api retry of", outer.EventID+":", r.Header.Get("X-Slack-Retry-Reason"))
+				break
+			}
+
+			ev, ok := parseEventsAPIEvent(outer.Event, botUserID)
+			if !ok {
+				break
+			}
+
+			// Slack wants an answer within 3 seconds, so don't keep it
+			// waiting if the events channel is backed up
+			go func() {
+				events <- ev
+			}()
+		default:
+			log.Println("ignoring events api request of type", outer.Type)
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// parseEventsAPIEvent converts the inner event of an Events API callback to
+// the RTM event it's equivalent to.
+func parseEventsAPIEvent(raw json.RawMessage, botUserID string) (ev slack.RTMEvent, ok bool) {
+	var inner struct {
+		Type    string `json:"type"`
+		User    string `json:"user"`
+		Channel string `json:"channel"`
+	}
+	if err := json.Unmarshal(raw, &inner); err != nil {
+		log.Println("error parsing events api event:", err)
+		return ev, false
+	}
+
+	// RTM tells us about joining a channel with channel_joined, the Events
+	// API with a member_joined_channel about ourselves
+	if inner.Type == "member_joined_channel" && inner.User == botUserID {
+		joined := &slack.ChannelJoinedEvent{Type: "channel_joined"}
+		joined.Channel.ID = inner.Channel
+
+		return slack.RTMEvent{Type: joined.Type, Data: joined}, true
+	}
+
+	template, known := slack.EventMapping[inner.Type]
+	if !known || !util.Contains(eventsAPITypes, inner.Type) {
+		log.Println("ignoring unknown events api event", inner.Type)
+		return ev, false
+	}
+
+	data := reflect.New(reflect.TypeOf(template)).Interface()
+	if err := json.Unmarshal(raw, data); err != nil {
+		log.Println("error parsing events api", inner.Type, "event:", err)
+		return ev, false
+	}
+
+	return slack.RTMEvent{Type: inner.Type, Data: data}, true
+}
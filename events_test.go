@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+const testSigningSecret = "signing-secret"
+
+// signedRequest makes an Events API request signed like Slack would.
+func signedRequest(secret, body string) *http.Request {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":" + body))
+
+	r := httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(body))
+	r.Header.Set("X-Slack-Request-Timestamp", ts)
+	r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+
+	return r
+}
+
+func TestEventsAPIURLVerification(t *testing.T) {
+	h := eventsAPIHandler(testSigningSecret, "UBOT", make(chan slack.RTMEvent, 1))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, signedRequest(testSigningSecret, `{"type":"url_verification","challenge":"abc123"}`))
+
+	if w.Code != http.StatusOK || w.Body.String() != "abc123" {
+		t.Errorf("got %d %q, want 200 and the challenge", w.Code, w.Body.String())
+	}
+}
+
+func TestEventsAPIRejectsBadSignature(t *testing.T) {
+	events := make(chan slack.RTMEvent, 1)
+	h := eventsAPIHandler(testSigningSecret, "UBOT", events)
+
+	body := `{"type":"event_callback","event_id":"Ev1","event":{"type":"message","user":"UALICE001","channel":"CGENERAL1","text":"hi"}}`
+
+	tests := []struct {
+		name string
+		r    *http.Request
+	}{
+		{"wrong secret", signedRequest("not-the-secret", body)},
+		{"unsigned", httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(body))},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, test.r)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d, want 401", test.name, w.Code)
+		}
+	}
+
+	select {
+	case ev := <-events:
+		t.Errorf("got %v from a request that wasn't signed right", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEventsAPIDedupesRetries(t *testing.T) {
+	events := make(chan slack.RTMEvent, 10)
+	h := eventsAPIHandler(testSigningSecret, "UBOT", events)
+
+	send := func(eventID, text string, retry bool) {
+		body := `{"type":"event_callback","event_id":"` + eventID + `","event":{"type":"message","user":"UALICE001","channel":"CGENERAL1","text":"` + text + `"}}`
+
+		r := signedRequest(testSigningSecret, body)
+		if retry {
+			r.Header.Set("X-Slack-Retry-Num", "1")
+			r.Header.Set("X-Slack-Retry-Reason", "http_timeout")
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("got %d for %s, want 200", w.Code, eventID)
+		}
+	}
+
+	send("Ev1", "first", false)
+	send("Ev1", "first", true)
+
+	// a retry of something we never got still has to come through
+	send("Ev2", "second", true)
+	send("Ev2", "second", true)
+
+	got := []string{}
+	timeout := time.After(time.Second)
+	for len(got) < 2 {
+		select {
+		case ev := <-events:
+			got = append(got, ev.Data.(*slack.MessageEvent).Text)
+		case <-timeout:
+			t.Fatalf("got %v, want first and second", got)
+		}
+	}
+
+	select {
+	case ev := <-events:
+		t.Errorf("got duplicate %v", ev.Data)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if !(got[0] == "first" && got[1] == "second" || got[0] == "second" && got[1] == "first") {
+		t.Errorf("got %v, want first and second", got)
+	}
+}
@@ -0,0 +1,273 @@
+package geo
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ways of coarsening locations before anyone sees them.
+const (
+	// SnapGrid moves points to the middle of a grid cell.
+	SnapGrid = "grid"
+
+	// SnapCity moves points to the grid cell in the middle of where everyone
+	// active in the same city is, falling back to the grid for points without
+	// a city.
+	SnapCity = "city"
+
+	// SnapOff leaves points exactly where they are. Only for testing.
+	SnapOff = "off"
+)
+
+// AnonymizerOptions configures an Anonymizer. Zero values get sensible
+// defaults.
+type AnonymizerOptions struct {
+	// Snap is SnapGrid, SnapCity or SnapOff. Defaults to SnapGrid.
+	Snap string
+
+	// GridSize is the size of grid cells in degrees. Defaults to 1, roughly
+	// 100km.
+	GridSize float64
+
+	// Jitter is how far in degrees each user is moved from the snapped point,
+	// at most, so users in the same place don't all sit on one dot. Defaults
+	// to a quarter of GridSize. Negative means no jitter.
+	Jitter float64
+
+	// MinUsers is how many users have to be active in a region, a grid cell
+	// or city, before anyone's location there is shown. Defaults to 3.
+	MinUsers int
+
+	// Window is how long users count as active in a region after we last saw
+	// them there. Defaults to an hour.
+	Window time.Duration
+
+	// Secret keys each user's jitter, so it's the same every time but can't
+	// be worked out from their user ID. Defaults to a random one, which
+	// changes every restart.
+	Secret []byte
+}
+
+// An Anonymizer coarsens locations so they can't be traced back to a user.
+// It's safe for concurrent use.
+type Anonymizer struct {
+	opts AnonymizerOptions
+
+	mu sync.Mutex
+
+	// users active in each region, and when we last saw them there
+	regions map[string]map[string]time.Time
+
+	// the region each user was last seen in
+	userRegions map[string]string
+
+	// where each user in each city is, for the city's centroid
+	cities map[string]map[string]GeoPoint
+
+	lastSweep time.Time
+}
+
+func NewAnonymizer(opts AnonymizerOptions) (*Anonymizer, error) {
+	switch opts.Snap {
+	case "":
+		opts.Snap = SnapGrid
+	case SnapGrid, SnapCity, SnapOff:
+	default:
+		return nil, fmt.Errorf("unknown location snapping %q, want %q, %q or %q", opts.Snap, SnapGrid, SnapCity, SnapOff)
+	}
+
+	if opts.GridSize <= 0 {
+		opts.GridSize = 1
+	}
+	if opts.Jitter == 0 {
+		opts.Jitter = opts.GridSize / 4
+	}
+	if opts.Jitter < 0 {
+		opts.Jitter = 0
+	}
+	if opts.MinUsers <= 0 {
+		opts.MinUsers = 3
+	}
+	if opts.Window <= 0 {
+		opts.Window = time.Hour
+	}
+	if len(opts.Secret) == 0 {
+		opts.Secret = make([]byte, 32)
+		if _, err := rand.Read(opts.Secret); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Anonymizer{
+		opts:        opts,
+		regions:     make(map[string]map[string]time.Time),
+		userRegions: make(map[string]string),
+		cities:      make(map[string]map[string]GeoPoint),
+	}, nil
+}
+
+// Anonymize returns where to show userId, who is at p in city, or false if
+// too few users are active nearby to show them at all. city may be empty if
+// it isn't known.
+func (a *Anonymizer) Anonymize(userId string, p GeoPoint, city string) (GeoPoint, bool) {
+	if a.opts.Snap == SnapOff {
+		return p, true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.sweep(now)
+
+	snapped, region := a.snap(userId, p, city)
+	if a.see(userId, region, now) < a.opts.MinUsers {
+		return GeoPoint{}, false
+	}
+
+	return a.jitter(userId, snapped), true
+}
+
+// snap coarsens userId's location p and returns the region it's in.
+func (a *Anonymizer) snap(userId string, p GeoPoint, city string) (GeoPoint, string) {
+	if a.opts.Snap == SnapCity && city != "" {
+		points, ok := a.cities[city]
+		if !ok {
+			points = make(map[string]GeoPoint)
+			a.cities[city] = points
+		}
+		points[userId] = p
+
+		var centroid GeoPoint
+		for _, point := range points {
+			centroid.Lat += point.Lat / float64(len(points))
+			centroid.Lon += point.Lon / float64(len(points))
+		}
+
+		// the centroid of a couple of users is pretty much where they are,
+		// so it's coarsened like any other point
+		snapped, _, _ := a.cell(centroid)
+
+		return snapped, "city:" + city
+	}
+
+	snapped, row, col := a.cell(p)
+
+	return snapped, fmt.Sprintf("grid:%v,%v", row, col)
+}
+
+// cell returns the middle of the grid cell p is in, and the cell's row and
+// column.
+func (a *Anonymizer) cell(p GeoPoint) (GeoPoint, float64, float64) {
+	size := a.opts.GridSize
+	row := math.Floor(p.Lat / size)
+	col := math.Floor(p.Lon / size)
+
+	middle := GeoPoint{
+		Lat: clampLat((row + 0.5) * size),
+		Lon: wrapLon((col + 0.5) * size),
+	}
+
+	return middle, row, col
+}
+
+// see records userId as active in region and returns how many users are.
+func (a *Anonymizer) see(userId, region string, now time.Time) int {
+	if old, ok := a.userRegions[userId]; ok && old != region {
+		a.forget(userId, old)
+	}
+	a.userRegions[userId] = region
+
+	users, ok := a.regions[region]
+	if !ok {
+		users = make(map[string]time.Time)
+		a.regions[region] = users
+	}
+	users[userId] = now
+
+	active := 0
+	for _, seen := range users {
+		if now.Sub(seen) <= a.opts.Window {
+			active++
+		}
+	}
+
+	return active
+}
+
+// sweep forgets users we haven't seen for a while, at most once a window.
+func (a *Anonymizer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < a.opts.Window {
+		return
+	}
+	a.lastSweep = now
+
+	for region, users := range a.regions {
+		for userId, seen := range users {
+			if now.Sub(seen) > a.opts.Window {
+				a.forget(userId, region)
+				delete(a.userRegions, userId)
+			}
+		}
+	}
+}
+
+// forget removes userId from region.
+func (a *Anonymizer) forget(userId, region string) {
+	delete(a.regions[region], userId)
+	if len(a.regions[region]) == 0 {
+		delete(a.regions, region)
+	}
+
+	if strings.HasPrefix(region, "city:") {
+		city := strings.TrimPrefix(region, "city:")
+
+		delete(a.cities[city], userId)
+		if len(a.cities[city]) == 0 {
+			delete(a.cities, city)
+		}
+	}
+}
+
+// jitter moves p by an offset that's always the same for userId.
+func (a *Anonymizer) jitter(userId string, p GeoPoint) GeoPoint {
+	if a.opts.Jitter == 0 {
+		return p
+	}
+
+	mac := hmac.New(sha256.New, a.opts.Secret)
+	mac.Write([]byte(userId))
+	sum := mac.Sum(nil)
+
+	return GeoPoint{
+		Lat: clampLat(p.Lat + a.opts.Jitter*unitOffset(sum[0:8])),
+		Lon: wrapLon(p.Lon + a.opts.Jitter*unitOffset(sum[8:16])),
+	}
+}
+
+// unitOffset turns 8 random bytes into a number between -1 and 1.
+func unitOffset(b []byte) float64 {
+	return float64(binary.BigEndian.Uint64(b))/math.MaxUint64*2 - 1
+}
+
+func clampLat(lat float64) float64 {
+	return math.Max(-90, math.Min(90, lat))
+}
+
+func wrapLon(lon float64) float64 {
+	for lon > 180 {
+		lon -= 360
+	}
+	for lon < -180 {
+		lon += 360
+	}
+
+	return lon
+}
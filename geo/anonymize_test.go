@@ -0,0 +1,117 @@
+package geo
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestAnonymizer(t *testing.T, opts AnonymizerOptions) *Anonymizer {
+	a, err := NewAnonymizer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func TestAnonymizeMinUsers(t *testing.T) {
+	a := newTestAnonymizer(t, AnonymizerOptions{MinUsers: 3, Jitter: -1})
+	p := GeoPoint{Lat: 37.77, Lon: -122.41}
+
+	for i, userId := range []string{"U1", "U2"} {
+		if got, ok := a.Anonymize(userId, p, ""); ok {
+			t.Errorf("user %d of 3 was shown at %v, want nothing published", i+1, got)
+		}
+	}
+
+	// the third user makes the cell busy enough to show everyone in it
+	for _, userId := range []string{"U3", "U1", "U2"} {
+		if _, ok := a.Anonymize(userId, p, ""); !ok {
+			t.Errorf("%s wasn't shown with 3 users active", userId)
+		}
+	}
+
+	// someone alone in another cell still isn't
+	if got, ok := a.Anonymize("U4", GeoPoint{Lat: 51.5, Lon: -0.12}, ""); ok {
+		t.Errorf("lone user was shown at %v", got)
+	}
+}
+
+func TestAnonymizeForgetsInactiveUsers(t *testing.T) {
+	a := newTestAnonymizer(t, AnonymizerOptions{MinUsers: 2, Jitter: -1, Window: 20 * time.Millisecond})
+	p := GeoPoint{Lat: 37.77, Lon: -122.41}
+
+	a.Anonymize("U1", p, "")
+	time.Sleep(30 * time.Millisecond)
+
+	if got, ok := a.Anonymize("U2", p, ""); ok {
+		t.Errorf("shown at %v with the only other user gone quiet, want nothing published", got)
+	}
+}
+
+func TestAnonymizeSnapsToGrid(t *testing.T) {
+	a := newTestAnonymizer(t, AnonymizerOptions{GridSize: 1, Jitter: -1, MinUsers: 1})
+
+	tests := []struct {
+		p    GeoPoint
+		want GeoPoint
+	}{
+		{GeoPoint{Lat: 37.77, Lon: -122.41}, GeoPoint{Lat: 37.5, Lon: -122.5}},
+		{GeoPoint{Lat: 37.01, Lon: -122.99}, GeoPoint{Lat: 37.5, Lon: -122.5}},
+		{GeoPoint{Lat: -33.86, Lon: 151.2}, GeoPoint{Lat: -33.5, Lon: 151.5}},
+		{GeoPoint{Lat: 0, Lon: 0}, GeoPoint{Lat: 0.5, Lon: 0.5}},
+	}
+
+	for i, test := range tests {
+		got, ok := a.Anonymize("U"+strconv.Itoa(i), test.p, "")
+		if !ok || !near(got, test.want) {
+			t.Errorf("%v snapped to %v %v, want %v", test.p, got, ok, test.want)
+		}
+	}
+}
+
+func TestAnonymizeSnapsCitiesToGrid(t *testing.T) {
+	a := newTestAnonymizer(t, AnonymizerOptions{Snap: SnapCity, GridSize: 1, Jitter: -1, MinUsers: 2})
+
+	a.Anonymize("U1", GeoPoint{Lat: 37.70, Lon: -122.40}, "San Francisco")
+	got, ok := a.Anonymize("U2", GeoPoint{Lat: 37.80, Lon: -122.50}, "San Francisco")
+
+	// the middle of the two users is 37.75,-122.45, which mustn't be shown
+	want := GeoPoint{Lat: 37.5, Lon: -122.5}
+	if !ok || !near(got, want) {
+		t.Errorf("city snapped to %v %v, want the grid cell at %v", got, ok, want)
+	}
+}
+
+func TestAnonymizeJitter(t *testing.T) {
+	opts := AnonymizerOptions{GridSize: 1, Jitter: 0.25, MinUsers: 1, Secret: []byte("secret")}
+	a := newTestAnonymizer(t, opts)
+	p := GeoPoint{Lat: 37.77, Lon: -122.41}
+	middle := GeoPoint{Lat: 37.5, Lon: -122.5}
+
+	first, _ := a.Anonymize("U1", p, "")
+	again, _ := a.Anonymize("U1", GeoPoint{Lat: 37.2, Lon: -122.9}, "")
+	if first != again {
+		t.Errorf("U1 moved from %v to %v within the same cell, want the same offset", first, again)
+	}
+
+	if math.Abs(first.Lat-middle.Lat) > opts.Jitter || math.Abs(first.Lon-middle.Lon) > opts.Jitter {
+		t.Errorf("U1 jittered to %v, more than %v from %v", first, opts.Jitter, middle)
+	}
+
+	if other, _ := a.Anonymize("U2", p, ""); other == first {
+		t.Errorf("U1 and U2 both at %v, want different offsets", first)
+	}
+
+	// the same secret gives the same offset after a restart
+	restarted := newTestAnonymizer(t, opts)
+	if got, _ := restarted.Anonymize("U1", p, ""); got != first {
+		t.Errorf("U1 at %v after restarting, want %v", got, first)
+	}
+}
+
+func near(a, b GeoPoint) bool {
+	return math.Abs(a.Lat-b.Lat) < 1e-9 && math.Abs(a.Lon-b.Lon) < 1e-9
+}
@@ -0,0 +1,63 @@
+// Package geo has the coordinates we put on the map.
+package geo
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A GeoPoint is a point on the map, in degrees.
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Parse parses a "lat,lon" location like ipinfo's loc, eg.
+// "37.7749,-122.4194".
+func Parse(loc string) (GeoPoint, error) {
+	parts := strings.Split(loc, ",")
+	if len(parts) != 2 {
+		return GeoPoint{}, fmt.Errorf("invalid location %q: want \"lat,lon\"", loc)
+	}
+
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return GeoPoint{}, fmt.Errorf("invalid latitude in location %q", loc)
+	}
+
+	lon, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return GeoPoint{}, fmt.Errorf("invalid longitude in location %q", loc)
+	}
+
+	p := GeoPoint{Lat: lat, Lon: lon}
+	if err := p.Validate(); err != nil {
+		return GeoPoint{}, fmt.Errorf("invalid location %q: %v", loc, err)
+	}
+
+	return p, nil
+}
+
+// Validate checks that p is somewhere on Earth.
+func (p GeoPoint) Validate() error {
+	if math.IsNaN(p.Lat) || p.Lat < -90 || p.Lat > 90 {
+		return fmt.Errorf("latitude %v out of range", p.Lat)
+	}
+
+	if math.IsNaN(p.Lon) || p.Lon < -180 || p.Lon > 180 {
+		return fmt.Errorf("longitude %v out of range", p.Lon)
+	}
+
+	return nil
+}
+
+// Strings formats p as latitude and longitude strings, the way locations used
+// to be sent.
+func (p GeoPoint) Strings() []string {
+	return []string{
+		strconv.FormatFloat(p.Lat, 'f', -1, 64),
+		strconv.FormatFloat(p.Lon, 'f', -1, 64),
+	}
+}
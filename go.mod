@@ -5,7 +5,7 @@ go 1.14
 require (
 	github.com/go-redis/redis v6.15.7+incompatible
 	github.com/gorilla/websocket v1.4.2
-	github.com/ipinfo/go-ipinfo v0.0.0-20191007010427-68bd5cb5356e // indirect
+	github.com/ipinfo/go-ipinfo v0.0.0-20191007010427-68bd5cb5356e
 	github.com/joho/godotenv v1.3.0
 	github.com/nlopes/slack v0.6.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// how many changes the history commands reply with
+const historyMessageLength = 10
+
+// optOutHistoryMessage describes the most recent opt-out changes to a user or
+// channel, or to whether a user's location is shown, ready to be sent back to
+// Slack.
+func optOutHistoryMessage(config Config, kind, target string) string {
+	changes, err := config.OptOutHistory(kind, target, historyMessageLength)
+	if err != nil {
+		log.Println("error getting opt-out history:", err)
+		return "sorry, i couldn't look up the history right now"
+	}
+
+	// what the changes are to, and what changing it is called
+	subject, setting := "stream you", "streaming"
+	switch kind {
+	case optOutChannel:
+		subject = "stream this channel"
+	case optOutLocation:
+		subject, setting = "show your location", "location sharing"
+	}
+
+	if len(changes) == 0 {
+		return "nobody has changed whether i " + subject
+	}
+
+	lines := []string{"recent changes to whether i " + subject + ":"}
+
+	for _, change := range changes {
+		action := "disabled"
+		if change.Enabled {
+			action = "enabled"
+		}
+
+		date := fmt.Sprintf("<!date^%d^{date_short_pretty} at {time}|%s>",
+			change.Timestamp.Unix(), change.Timestamp.UTC().Format("2006-01-02 15:04 MST"))
+
+		line := "• " + date + ": <@" + change.Actor + "> " + action + " " + setting
+		if change.Source != "" {
+			line += " with `" + change.Source + "`"
+		}
+
+		lines = append(lines, line)
+	}
+
+	if len(changes) == historyMessageLength {
+		lines = append(lines, "_showing the last "+strconv.Itoa(historyMessageLength)+" changes_")
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -5,29 +5,70 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/hackclub/streambot/geo"
+	"github.com/hackclub/streambot/util"
+	"github.com/hackclub/streambot/ws"
 	ipinfoApi "github.com/ipinfo/go-ipinfo/ipinfo"
 	"github.com/joho/godotenv"
 	"github.com/slack-go/slack"
-	"github.com/hackclub/streambot/util"
-	"github.com/hackclub/streambot/ws"
 )
 
 var (
 	redisURL                       string
 	authToken                      string
 	streamChannel                  string
+	signingSecret                  string
+	transport                      string
+	appToken                       string
+	replayFile                     string
+	recordFile                     string
+	slackAPIURL                    string
+	joinNewChannels                bool
 	ignoreChannelsCreatedByUserIds []string
 )
 
 func main() {
 	godotenv.Load()
 
+	// `streambot token [ttl]` prints a websocket access token and exits
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		printToken(os.Args[2:])
+		return
+	}
+
 	redisURL = os.Getenv("REDIS_URL")
 	authToken = os.Getenv("AUTH_TOKEN")
 	streamChannel = os.Getenv("STREAM_CHANNEL")
+	signingSecret = os.Getenv("SLACK_SIGNING_SECRET")
+
+	// How streambot gets events from Slack: "rtm" (the default), "events"
+	// for the Events API, which Slack will POST to /slack/events, or "socket"
+	// for Socket Mode, which needs an app-level token in SLACK_APP_TOKEN.
+	transport = os.Getenv("TRANSPORT")
+	appToken = os.Getenv("SLACK_APP_TOKEN")
+
+	// TRANSPORT=replay plays back events from REPLAY_FILE instead of
+	// connecting to Slack. Events from any transport can be recorded to
+	// RECORD_FILE for replaying later.
+	replayFile = os.Getenv("REPLAY_FILE")
+	recordFile = os.Getenv("RECORD_FILE")
+
+	// Where to find Slack's Web API. Only worth changing to point streambot
+	// at a stand-in like slackfake.
+	slackAPIURL = os.Getenv("SLACK_API_URL")
+	if slackAPIURL == "" {
+		slackAPIURL = slack.APIURL
+	} else if !strings.HasSuffix(slackAPIURL, "/") {
+		slackAPIURL += "/"
+	}
+
+	// JOIN_NEW_CHANNELS=true joins channels as soon as they're created.
+	// Otherwise streambot only joins the channels there are when it starts.
+	joinNewChannels = os.Getenv("JOIN_NEW_CHANNELS") == "true"
 
 	// Comma separated list of Slack user IDs. Streambot will not join channels created by them.
 	ignoreChannelsCreatedByUserIds = strings.Split(os.Getenv("IGNORE_CHANNELS_CREATED_BY_USER_IDS"), ",")
@@ -45,327 +86,268 @@ func main() {
 		wsPort = "1337"
 	}
 
-	server := ws.NewServer(wsPort)
+	// Comma separated list of origins allowed to connect to the websocket, eg.
+	// "https://hackclub.com,https://*.hackclub.com". Any origin can if unset.
+	// If WS_TOKEN_SECRET is set clients also need a token from `streambot
+	// token`.
+	wsAuth := ws.Auth{}
+	if origins := os.Getenv("WS_ALLOWED_ORIGINS"); origins != "" {
+		wsAuth.AllowedOrigins = strings.Split(origins, ",")
+	} else {
+		fmt.Println("WS_ALLOWED_ORIGINS not set, allowing websocket connections from anywhere")
+	}
+	if secret := os.Getenv("WS_TOKEN_SECRET"); secret != "" {
+		wsAuth.TokenSecret = []byte(secret)
+	}
 
-	go server.Serve()
+	// How much recent activity to keep for reconnecting clients, and how much
+	// of it new clients get straight away. Negative WS_HISTORY_SIZE keeps none
+	// and negative WS_REPLAY_COUNT sends none.
+	server := ws.NewServer(wsPort, ws.Options{
+		Auth:        wsAuth,
+		HistorySize: envInt("WS_HISTORY_SIZE"),
+		ReplayCount: envInt("WS_REPLAY_COUNT"),
+	})
 
 	// streambot (slack stuff)
-	config, err := NewConfig(redisURL)
-	fmt.Println(redisURL)
+	// REDIS_URL=memory keeps state in memory, losing it on restart
+	// ACTIVE_MEMBER_WINDOW is how long after they last said something users
+	// count as active in a channel, eg. "30m". Defaults to an hour.
+	activeWindow := envDuration("ACTIVE_MEMBER_WINDOW")
+	config, err := NewConfig(redisURL, activeWindow)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	api := slack.New(authToken)
-
-	rtm := api.NewRTM()
-	go rtm.ManageConnection()
+	api := slack.New(authToken, slack.OptionAPIURL(slackAPIURL))
 
-	go func() {
-		for range time.Tick(10 * time.Second) {
-			fmt.Println("polling access logs to update ip info in db")
+	// only needed when replaying without a token to ask Slack with
+	botUserID := os.Getenv("BOT_USER_ID")
 
-			logins, _, err := api.GetAccessLogs(slack.AccessLogParameters{1000, 0})
-			if err != nil {
-				fmt.Println("error getting access logs:", err)
-				return
-			}
+	auth, err := api.AuthTest()
+	if err == nil {
+		botUserID = auth.UserID
+	} else if transport == "replay" {
+		log.Println("error authenticating with slack, carrying on because we're replaying:", err)
+	} else {
+		log.Fatal("error authenticating with slack: ", err)
+	}
 
-			for _, login := range logins {
-				_, present, err := config.GetIPInfo(login.IP)
-				if err != nil {
-					log.Println("error checking IP info in DB:", err)
-					continue
-				}
+	// Locations are coarsened before they're sent anywhere. LOCATION_SNAP is
+	// "grid" (the default) or "city", LOCATION_GRID_SIZE and LOCATION_JITTER
+	// are in degrees, and nobody's location is shown until LOCATION_MIN_USERS
+	// are active in the same grid cell or city within ACTIVE_MEMBER_WINDOW.
+	// LOCATION_JITTER_SECRET keeps each user's jitter the same across
+	// restarts, without it everyone moves a bit every restart.
+	anonymizer, err := geo.NewAnonymizer(geo.AnonymizerOptions{
+		Snap:     os.Getenv("LOCATION_SNAP"),
+		GridSize: envFloat("LOCATION_GRID_SIZE"),
+		Jitter:   envFloat("LOCATION_JITTER"),
+		MinUsers: envInt("LOCATION_MIN_USERS"),
+		Window:   activeWindow,
+		Secret:   []byte(os.Getenv("LOCATION_JITTER_SECRET")),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
-				// don't get an ip's info twice to save api calls
-				if !present {
-					info, err := ipinfo.GetInfo(net.ParseIP(login.IP))
-					if err != nil {
-						log.Println("error getting ipinfo:", err)
-						continue
-					}
-
-					if err := config.StoreIPInfo(*info); err != nil {
-						log.Println("error storing ip info:", err)
-						continue
-					}
-				}
+	// everything but connecting to Slack goes through the rate limited client
+	client := newSlackClient(api)
 
-				config.StoreUserIP(login.UserID, login.IP)
-			}
+	b := newBot(client, config, server, anonymizer, botUserID)
 
-			fmt.Println("done!")
-		}
-	}()
+	// debug endpoints need a websocket token, so they're only served when
+	// there's a secret to make them with
+	if len(wsAuth.TokenSecret) > 0 {
+		server.Handle("/debug/slack-queues", wsAuth.Require(queueDepthHandler(client)))
+		server.Handle("/debug/locations", wsAuth.Require(locationStatsHandler(b.activities)))
+	} else {
+		fmt.Println("WS_TOKEN_SECRET not set, not serving debug endpoints")
+	}
 
-	go func() {
-		channels, _ := rtm.GetChannels(true)
-		for _, channel := range channels {
-			if util.Contains(ignoreChannelsCreatedByUserIds, channel.Creator) {
-				continue
-			}
+	// replays handle one event at a time so they come out the same every run
+	b.inOrder = transport == "replay"
 
-			fmt.Println("joining", channel.Name)
+	if signingSecret != "" {
+		server.Handle("/slack/commands", slashCommandHandler(signingSecret, b.commands))
+	} else {
+		fmt.Println("SLACK_SIGNING_SECRET not set, not accepting slash commands")
+	}
 
-			rtm.JoinChannel(channel.Name)
+	var source EventSource
 
-			time.Sleep((5 * time.Second))
+	switch transport {
+	case "rtm", "":
+		rtm := api.NewRTM()
+		go rtm.ManageConnection()
 
-			fmt.Println(channel.ID)
+		source = newSlackEventSource(rtm.IncomingEvents)
+	case "events":
+		if signingSecret == "" {
+			log.Fatal("SLACK_SIGNING_SECRET must be set to use the events api")
 		}
-	}()
-
-	for msg := range rtm.IncomingEvents {
-		fmt.Println("Event Received:", msg)
-
-		go func() {
-			toSend := ws.NewActivity(msg.Type, "")
-
-			switch ev := msg.Data.(type) {
-			case *slack.MessageEvent:
-				if ev.User == "USLACKBOT" || ev.User == "" || ev.Channel == streamChannel {
-					return
-				}
-
-				// Ignore messages if not in a public channel
-				if !strings.HasPrefix(ev.Channel, "C") {
-					fmt.Println(ev.Channel, "ignoring because not public")
-					return
-				}
 
-				channel, err := rtm.GetChannelInfo(ev.Channel)
-				if err != nil {
-					log.Println("Error getting channel info:", err)
-					return
-				}
+		events := make(chan slack.RTMEvent, 50)
+		server.Handle("/slack/events", eventsAPIHandler(signingSecret, botUserID, events))
 
-				toSend.ChannelName = "#" + channel.Name
+		source = newSlackEventSource(events)
+	case "socket":
+		if appToken == "" {
+			log.Fatal("SLACK_APP_TOKEN must be set to use socket mode")
+		}
 
-				config.RegisterActiveUserInChannel(ev.Channel, ev.User)
+		events := make(chan slack.RTMEvent, 50)
+		go newSocketModeClient(appToken, slackAPIURL, botUserID, b.commands, events).Run()
 
-				// add from user info
-				// todo remove duplication
-				info, present, err := config.GetUserIPInfo(ev.User)
-				if err != nil {
-					log.Println("Error getting current user's IP info:", err)
-				} else if !present {
-					log.Println("User's IP info not in DB.")
-				} else {
-					toSend.From = strings.Split(info.Location, ",")
-				}
+		source = newSlackEventSource(events)
+	case "replay":
+		source, err = newReplayEventSource(replayFile)
+		if err != nil {
+			log.Fatal("error opening events to replay: ", err)
+		}
+	default:
+		log.Fatal("unknown TRANSPORT ", transport)
+	}
 
-				userIds, err := config.GetActiveUsersInChannel(ev.Channel)
-				if err != nil {
-					log.Println("error getting active users in channel from DB:", err)
-				} else {
-					activeLocations := [][]string{}
-
-					for _, userId := range userIds {
-						info, present, err := config.GetUserIPInfo(userId)
-						if err != nil {
-							log.Println("Error getting active user's IP info:", err)
-						} else if !present {
-							log.Println("User's IP info not in DB.")
-						} else {
-							activeLocations = append(activeLocations, strings.Split(info.Location, ","))
-						}
-					}
-
-					toSend.To = activeLocations
-				}
-			case *slack.UserTypingEvent:
-				if ev.User == "USLACKBOT" || ev.User == "" || ev.Channel == streamChannel {
-					return
-				}
+	go server.Serve()
 
-				// Ignore messages if not in a public channel
-				if !strings.HasPrefix(ev.Channel, "C") {
-					fmt.Println(ev.Channel, "ignoring because not public")
-					return
-				}
+	// replays shouldn't touch the real workspace
+	if transport != "replay" {
+		go pollAccessLogs(client, config, ipinfo)
+		go joinChannels(client)
+	}
 
-				channel, err := rtm.GetChannelInfo(ev.Channel)
-				if err != nil {
-					log.Println("Error getting channel info:", err)
-					return
-				}
+	if recordFile != "" {
+		source, err = newRecordingEventSource(source, recordFile)
+		if err != nil {
+			log.Fatal("error opening file to record events to: ", err)
+		}
+	}
 
-				toSend.ChannelName = "#" + channel.Name
+	b.Run(source)
+}
 
-				config.RegisterActiveUserInChannel(ev.Channel, ev.User)
+// printToken prints a websocket access token signed with WS_TOKEN_SECRET,
+// valid for the duration in args, or a day by default.
+func printToken(args []string) {
+	secret := os.Getenv("WS_TOKEN_SECRET")
+	if secret == "" {
+		log.Fatal("WS_TOKEN_SECRET must be set to make tokens")
+	}
 
-				// add from user info
-				// todo remove duplication
-				info, present, err := config.GetUserIPInfo(ev.User)
-				if err != nil {
-					log.Println("Error getting current user's IP info:", err)
-				} else if !present {
-					log.Println("User's IP info not in DB.")
-				} else {
-					toSend.From = strings.Split(info.Location, ",")
-				}
+	ttl := 24 * time.Hour
+	if len(args) > 0 {
+		var err error
+		ttl, err = time.ParseDuration(args[0])
+		if err != nil {
+			log.Fatal("invalid token ttl: ", err)
+		}
+	}
 
-				userIds, err := config.GetActiveUsersInChannel(ev.Channel)
-				if err != nil {
-					log.Println("error getting active users in channel from DB:", err)
-				} else {
-					activeLocations := [][]string{}
-
-					for _, userId := range userIds {
-						info, present, err := config.GetUserIPInfo(userId)
-						if err != nil {
-							log.Println("Error getting active user's IP info:", err)
-						} else if !present {
-							log.Println("User's IP info not in DB.")
-						} else {
-							activeLocations = append(activeLocations, strings.Split(info.Location, ","))
-						}
-					}
-
-					toSend.To = activeLocations
-				}
-			case *slack.ReactionAddedEvent:
-				// Ignore messages if not in a public channel
-				if !strings.HasPrefix(ev.Item.Channel, "C") {
-					fmt.Println(ev.Item.Channel, "ignoring because not public")
-					return
-				}
+	fmt.Println(ws.NewToken([]byte(secret), ttl))
+}
 
-				channel, err := rtm.GetChannelInfo(ev.Item.Channel)
-				if err != nil {
-					log.Println("Error getting channel info:", err)
-					return
-				}
+// envInt reads an integer from the environment, or 0 if it isn't set.
+func envInt(name string) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return 0
+	}
 
-				toSend.ChannelName = "#" + channel.Name
-				toSend.Reaction = ev.Reaction
-			}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
 
-			// log message type to ws
-			server.Broadcast(toSend)
-		}()
+	return n
+}
 
-		switch ev := msg.Data.(type) {
-		case *slack.MessageEvent:
-			if ev.User == "USLACKBOT" || ev.User == "" || ev.Channel == streamChannel {
-				continue
-			}
+// envDuration reads a duration like "30m" from the environment, or 0 if it
+// isn't set.
+func envDuration(name string) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return 0
+	}
 
-			// Ignore messages if not in a public channel
-			if !strings.HasPrefix(ev.Channel, "C") {
-				fmt.Println(ev.Channel, "ignoring because not public")
-				continue
-			}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
 
-			if strings.HasSuffix(ev.Text, "status me") {
-				status := config.UserActive(ev.User)
-				msg := ""
+	return d
+}
 
-				if status {
-					msg = "i am streaming your messages"
-				} else {
-					msg = "i am ignoring your messages"
-				}
+// envFloat reads a number from the environment, or 0 if it isn't set.
+func envFloat(name string) float64 {
+	s := os.Getenv(name)
+	if s == "" {
+		return 0
+	}
 
-				rtm.SendMessage(rtm.NewOutgoingMessage(msg, ev.Channel))
-				continue
-			}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
 
-			if strings.HasSuffix(ev.Text, "disable me") {
-				config.DisableUser(ev.User)
+	return n
+}
 
-				rtm.SendMessage(rtm.NewOutgoingMessage("i will now ignore your messages", ev.Channel))
-				continue
-			}
+// pollAccessLogs keeps the IPs in Config up to date with the team's access
+// logs, looking up info for any IPs we haven't seen before.
+func pollAccessLogs(api *slackClient, config Config, ipinfo *ipinfoApi.Client) {
+	for range time.Tick(10 * time.Second) {
+		fmt.Println("polling access logs to update ip info in db")
 
-			if strings.HasSuffix(ev.Text, "enable me") {
-				config.EnableUser(ev.User)
+		logins, _, err := api.GetAccessLogs(slack.AccessLogParameters{Count: 1000, Page: 0})
+		if err != nil {
+			fmt.Println("error getting access logs:", err)
+			return
+		}
 
-				rtm.SendMessage(rtm.NewOutgoingMessage("i will now stream your messages", ev.Channel))
+		for _, login := range logins {
+			_, present, err := config.GetIPInfo(login.IP)
+			if err != nil {
+				log.Println("error checking IP info in DB:", err)
 				continue
 			}
 
-			if strings.HasSuffix(ev.Text, "status channel") {
-				status := config.ChannelActive(ev.Channel)
-				msg := ""
-
-				if status {
-					msg = "i am streaming this channel's messages"
-				} else {
-					msg = "i am ignoring this channel's messages"
+			// don't get an ip's info twice to save api calls
+			if !present {
+				info, err := ipinfo.GetInfo(net.ParseIP(login.IP))
+				if err != nil {
+					log.Println("error getting ipinfo:", err)
+					continue
 				}
 
-				rtm.SendMessage(rtm.NewOutgoingMessage(msg, ev.Channel))
-				continue
-			}
-
-			if strings.HasSuffix(ev.Text, "disable channel") {
-				config.DisableChannel(ev.Channel)
-
-				rtm.SendMessage(rtm.NewOutgoingMessage("i will now ignore this channel's messages", ev.Channel))
-				continue
-			}
-
-			if strings.HasSuffix(ev.Text, "enable channel") {
-				config.EnableChannel(ev.Channel)
-
-				rtm.SendMessage(rtm.NewOutgoingMessage("i will now stream this channel's messages", ev.Channel))
-				continue
-			}
-
-			if !config.ChannelActive(ev.Channel) {
-				fmt.Println("ignoring message because", ev.Channel, "is set to ignore")
-				continue
-			}
-
-			if !config.UserActive(ev.User) {
-				fmt.Println("ignoring message because", ev.User, "is set to ignore")
-				continue
-			}
-
-			fmt.Println(ev.Text)
-
-			go streamMsg(api, rtm, ev)
-		case *slack.UserTypingEvent:
-			if !config.ChannelActive(ev.Channel) {
-				fmt.Println("ignoring typing because", ev.Channel, "is set to ignore")
-				continue
+				if err := config.StoreIPInfo(*info); err != nil {
+					log.Println("error storing ip info:", err)
+					continue
+				}
 			}
 
-			if !config.UserActive(ev.User) {
-				fmt.Println("ignoring typing because", ev.User, "is set to ignore")
-				continue
-			}
+			config.StoreUserIP(login.UserID, login.IP)
+		}
 
-			go streamTyping(api, rtm, ev)
-		case *slack.MemberJoinedChannelEvent:
-			if ev.Channel == streamChannel {
-				attachment := slack.Attachment{
-					Color:    "#0040FF",
-					ImageURL: "https://i.imgur.com/4m3Rra5.gif",
-				}
+		fmt.Println("done!")
+	}
+}
 
-				_, err := api.PostEphemeral(streamChannel, ev.User, slack.MsgOptionAttachments(attachment), slack.MsgOptionAsUser(true))
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
-					continue
-				}
-			}
+// joinChannels joins every public channel, except ones created by people in
+// IGNORE_CHANNELS_CREATED_BY_USER_IDS.
+func joinChannels(api *slackClient) {
+	channels, _ := api.GetChannels(true)
+	for _, channel := range channels {
+		if util.Contains(ignoreChannelsCreatedByUserIds, channel.Creator) {
+			continue
+		}
 
-		case *slack.ChannelJoinedEvent:
-			fmt.Println(ev.Channel)
-			fmt.Println(ev.Type)
-			rtm.SendMessage(rtm.NewOutgoingMessage(
-				`:wave: hi! i'm a bot built by <@zrl> that streams channel activity to <#`+streamChannel+`> so people can easily discover new channels.
+		fmt.Println("joining", channel.Name)
 
-don't want your channel (or your account) to be part of this? that's ok! just type `+"`"+`<@streambot> disable me`+"`"+` to have me ignore all of your messages or `+"`"+`<@streambot> disable channel`+"`"+` to have me ignore this whole channel.
+		api.JoinChannel(channel.Name)
 
-if you want to re-enable streaming, you can type `+"`"+`<@streambot> enable me`+"`"+` or `+"`"+`<@streambot> enable channel`+"`"+` and if you want to check whether i'm streaming, you can type `+"`"+`<@streambot> status me`+"`"+` or `+"`"+`<@streambot> status channel`+"`"+`.
+		time.Sleep((5 * time.Second))
 
-i'll never stream private messages, group chats, or private channels. message <@zrl> if you have any questions. happy hacking!`, ev.Channel.ID))
-		case *slack.RTMError:
-			fmt.Fprintln(os.Stderr, "Error:", ev.Error())
-		}
+		fmt.Println(channel.ID)
 	}
 }
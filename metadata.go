@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hackclub/streambot/cache"
+	"github.com/slack-go/slack"
+)
+
+const (
+	metadataCacheSize = 10000
+	metadataCacheTTL  = time.Hour
+)
+
+// slackMetadata looks up users and channels, remembering them for a while so
+// every event doesn't cost an API call. Changes Slack tells us about are
+// picked up straight away with InvalidateUser and InvalidateChannel.
+type slackMetadata struct {
+	api *slackClient
+
+	users    *cache.LRU
+	channels *cache.LRU
+
+	// so many events for one user or channel at once only look it up once
+	lookups cache.Group
+
+	mu sync.Mutex
+
+	// bumped whenever a key is invalidated, so lookups that started before
+	// don't cache what they found
+	generations map[string]uint64
+}
+
+func newSlackMetadata(api *slackClient) *slackMetadata {
+	return &slackMetadata{
+		api:         api,
+		users:       cache.NewLRU(metadataCacheSize, metadataCacheTTL),
+		channels:    cache.NewLRU(metadataCacheSize, metadataCacheTTL),
+		generations: map[string]uint64{},
+	}
+}
+
+func (m *slackMetadata) User(id string) (*slack.User, error) {
+	user, err := m.lookup(m.users, "user/"+id, id, func() (interface{}, error) {
+		return m.api.GetUserInfo(id)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user.(*slack.User), nil
+}
+
+func (m *slackMetadata) Channel(id string) (*slack.Channel, error) {
+	channel, err := m.lookup(m.channels, "channel/"+id, id, func() (interface{}, error) {
+		return m.api.GetChannelInfo(id)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return channel.(*slack.Channel), nil
+}
+
+// InvalidateUser forgets what we know about a user, eg. because they've
+// changed their profile.
+func (m *slackMetadata) InvalidateUser(id string) {
+	m.invalidate(m.users, "user/"+id, id)
+}
+
+// InvalidateChannel forgets what we know about a channel, eg. because it's
+// been renamed or archived.
+func (m *slackMetadata) InvalidateChannel(id string) {
+	m.invalidate(m.channels, "channel/"+id, id)
+}
+
+// lookup returns the cached value for id, or looks it up with fetch.
+// flightKey identifies the lookup across both caches.
+func (m *slackMetadata) lookup(c *cache.LRU, flightKey, id string, fetch func() (interface{}, error)) (interface{}, error) {
+	if value, ok := c.Get(id); ok {
+		return value, nil
+	}
+
+	return m.lookups.Do(flightKey, func() (interface{}, error) {
+		generation := m.generation(flightKey)
+
+		value, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+
+		if m.generation(flightKey) == generation {
+			c.Add(id, value)
+		}
+
+		return value, nil
+	})
+}
+
+func (m *slackMetadata) invalidate(c *cache.LRU, flightKey, id string) {
+	m.mu.Lock()
+	m.generations[flightKey]++
+	m.mu.Unlock()
+
+	c.Remove(id)
+	m.lookups.Forget(flightKey)
+}
+
+func (m *slackMetadata) generation(flightKey string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.generations[flightKey]
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMetadataInvalidateDuringLookup(t *testing.T) {
+	b, fake, _ := newTestBot(t)
+	m := newSlackMetadata(b.api)
+
+	var mu sync.Mutex
+	name := "alice"
+
+	// the first lookup hangs until it's let go, so the user can change
+	// while it's still in flight
+	started, release := make(chan bool, 1), make(chan bool)
+	fake.Respond("users.info", func(values url.Values) interface{} {
+		mu.Lock()
+		found := name
+		mu.Unlock()
+
+		select {
+		case started <- true:
+			<-release
+		default:
+		}
+
+		return map[string]interface{}{
+			"ok":   true,
+			"user": map[string]interface{}{"id": values.Get("user"), "name": found},
+		}
+	})
+
+	done := make(chan bool)
+	go func() {
+		m.User("UALICE001")
+		close(done)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup never started")
+	}
+
+	mu.Lock()
+	name = "alice2"
+	mu.Unlock()
+	m.InvalidateUser("UALICE001")
+
+	close(release)
+	<-done
+
+	user, err := m.User("UALICE001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "alice2" {
+		t.Errorf("got %q after invalidating, want the new name cached instead of the stale lookup", user.Name)
+	}
+
+	if lookups := len(fake.Requests("users.info")); lookups != 2 {
+		t.Errorf("looked the user up %d times, want 2", lookups)
+	}
+
+	// and now the new name is cached
+	m.User("UALICE001")
+	if lookups := len(fake.Requests("users.info")); lookups != 2 {
+		t.Errorf("looked the user up %d times, want it cached after the second", lookups)
+	}
+}
@@ -1,15 +1,13 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"strings"
-	"time"
 
 	"github.com/slack-go/slack"
 )
 
-func streamMsgAttachment(api *slack.Client, attachment slack.Attachment) error {
+func streamMsgAttachment(api *slackClient, attachment slack.Attachment) error {
 	if attachment.Color == "" {
 		attachment.Color = "#0040FF"
 	}
@@ -22,8 +20,16 @@ func streamMsgAttachment(api *slack.Client, attachment slack.Attachment) error {
 	return nil
 }
 
-func streamMsg(api *slack.Client, rtm *slack.RTM, ev *slack.MessageEvent) {
-	user, err := rtm.GetUserInfo(ev.User)
+// sendMessage posts a plain text message, eg. a reply to a command.
+func sendMessage(api *slackClient, channel, text string) {
+	_, _, err := api.PostMessage(channel, slack.MsgOptionText(text, false), slack.MsgOptionAsUser(true))
+	if err != nil {
+		log.Println("error sending message:", err)
+	}
+}
+
+func streamMsg(api *slackClient, metadata *slackMetadata, ev Event) {
+	user, err := metadata.User(ev.User)
 	if err != nil {
 		log.Println("Error getting user:", err)
 		return
@@ -34,7 +40,7 @@ func streamMsg(api *slack.Client, rtm *slack.RTM, ev *slack.MessageEvent) {
 	if strings.HasPrefix(ev.Channel, "D") {
 		channelName = "In DM with streambot"
 	} else {
-		channel, err := rtm.GetChannelInfo(ev.Channel)
+		channel, err := metadata.Channel(ev.Channel)
 		if err != nil {
 			log.Println("Error getting channel info:", err)
 			return
@@ -54,38 +60,3 @@ func streamMsg(api *slack.Client, rtm *slack.RTM, ev *slack.MessageEvent) {
 
 	streamMsgAttachment(api, attachment)
 }
-
-func streamTyping(api *slack.Client, rtm *slack.RTM, ev *slack.UserTypingEvent) error {
-	user, err := rtm.GetUserInfo(ev.User)
-	if err != nil {
-		return err
-	}
-
-	channelName := ""
-
-	if strings.HasPrefix(ev.Channel, "D") {
-		channelName = "In DM with streambot"
-	} else {
-		fmt.Println(ev.Channel)
-		channel, err := rtm.GetChannelInfo(ev.Channel)
-		if err != nil {
-			log.Println("Error getting channel info:", err)
-			return err
-		}
-
-		channelName = "#" + channel.Name
-	}
-
-	channel, timestamp, err := api.PostMessage(streamChannel, slack.MsgOptionText("_"+user.Name+" is typing in "+channelName+"…_", false), slack.MsgOptionAsUser(true))
-	if err != nil {
-		return err
-	}
-
-	time.Sleep(1 * time.Second)
-
-	if _, _, err := api.DeleteMessage(channel, timestamp); err != nil {
-		return err
-	}
-
-	return nil
-}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/slack-go/slack"
+)
+
+func TestStreamMessages(t *testing.T) {
+	b, fake, _ := newTestBot(t)
+
+	b.config.DisableUser("UBOB00001", "UBOB00001", "disable me")
+
+	b.handle(Event{Type: eventMessage, User: "UALICE001", Channel: "CGENERAL1", Text: "hello world"})
+	b.handle(Event{Type: eventMessage, User: "UBOB00001", Channel: "CGENERAL1", Text: "don't stream this"})
+	b.handle(Event{Type: eventMessage, User: "UALICE001", Channel: "DALICE001", Text: "status me"})
+	b.handle(Event{Type: eventMessage, User: "UALICE001", Channel: testStreamChannel, Text: "already in the stream"})
+
+	streamed := fake.PostedMessages(testStreamChannel)
+	if len(streamed) != 1 {
+		t.Fatalf("streamed %d messages, want 1: %v", len(streamed), streamed)
+	}
+
+	var attachments []slack.Attachment
+	if err := json.Unmarshal([]byte(streamed[0].Get("attachments")), &attachments); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(attachments) != 1 {
+		t.Fatalf("streamed %d attachments, want 1", len(attachments))
+	}
+
+	a := attachments[0]
+	if a.Text != "hello world" || a.AuthorName != "alice" || a.AuthorSubname != "<#CGENERAL1>" {
+		t.Errorf("streamed %+v, want alice's message in #general", a)
+	}
+
+	if posted := fake.PostedMessages("CGENERAL1"); len(posted) != 0 {
+		t.Errorf("posted %v in #general, want nothing", posted)
+	}
+
+	replies := fake.PostedMessages("DALICE001")
+	if len(replies) != 1 || replies[0].Get("text") != "i am streaming your messages" {
+		t.Errorf("replied %v, want the status me reply", replies)
+	}
+}
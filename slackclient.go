@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	// how many calls to one method can be waiting before callers block
+	callQueueSize = 1000
+
+	// how many times a call that failed for a transient reason is tried
+	maxCallAttempts = 5
+
+	// how many times Slack can tell us to slow down before a call fails
+	maxRateLimitedRetries = 10
+)
+
+var (
+	minCallBackoff = time.Second
+	maxCallBackoff = 30 * time.Second
+
+	// how long a queue can go unused before it's stopped, so there isn't one
+	// left behind for every channel we've ever posted in
+	callQueueIdle = 10 * time.Minute
+)
+
+// Slack's rate limit tiers, as how often a method in them can be called.
+// chat.postMessage isn't in a tier, but allows about one message a second.
+var (
+	rateTier2       = time.Minute / 20
+	rateTier3       = time.Minute / 50
+	rateTier4       = time.Minute / 100
+	ratePostMessage = time.Second
+)
+
+// methodRates says how often each method we call can be called. Slack counts
+// every method separately, so each gets its own queue. chat.postMessage is
+// limited per channel, so it gets a queue per channel, and a busy stream
+// channel doesn't hold up replies to commands.
+var methodRates = map[string]time.Duration{
+	"chat.postMessage":   ratePostMessage,
+	"chat.postEphemeral": rateTier4,
+	"chat.update":        rateTier3,
+	"chat.delete":        rateTier3,
+	"users.info":         rateTier4,
+	"channels.info":      rateTier3,
+	"channels.list":      rateTier2,
+	"channels.join":      rateTier3,
+	"team.accessLogs":    rateTier2,
+}
+
+// slackClient makes the Slack Web API calls streambot needs without going
+// over Slack's rate limits. Calls to each method wait their turn in a queue
+// that goes no faster than the method's tier allows. A 429 pauses the queue
+// for as long as Slack asks, and transient failures are retried with backoff,
+// so busy periods slow things down instead of losing them. Queues that go
+// unused for a while are stopped, and started again when they're next needed.
+type slackClient struct {
+	api *slack.Client
+
+	mu     sync.Mutex
+	queues map[string]*callQueue
+}
+
+func newSlackClient(api *slack.Client) *slackClient {
+	return &slackClient{
+		api:    api,
+		queues: map[string]*callQueue{},
+	}
+}
+
+// QueueDepths returns how many calls in each queue are waiting or in
+// progress, by method, or method and channel for chat.postMessage.
+func (c *slackClient) QueueDepths() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	depths := map[string]int{}
+	for name, q := range c.queues {
+		depths[name] = int(atomic.LoadInt64(&q.depth))
+	}
+
+	return depths
+}
+
+func (c *slackClient) PostMessage(channelID string, options ...slack.MsgOption) (channel, timestamp string, err error) {
+	err = c.call("chat.postMessage", channelID, func() error {
+		channel, timestamp, err = c.api.PostMessage(channelID, options...)
+		return err
+	})
+
+	return channel, timestamp, err
+}
+
+func (c *slackClient) PostEphemeral(channelID, userID string, options ...slack.MsgOption) (timestamp string, err error) {
+	err = c.call("chat.postEphemeral", "", func() error {
+		timestamp, err = c.api.PostEphemeral(channelID, userID, options...)
+		return err
+	})
+
+	return timestamp, err
+}
+
+func (c *slackClient) UpdateMessage(channelID, messageTimestamp string, options ...slack.MsgOption) (channel, timestamp, text string, err error) {
+	err = c.call("chat.update", "", func() error {
+		channel, timestamp, text, err = c.api.UpdateMessage(channelID, messageTimestamp, options...)
+		return err
+	})
+
+	return channel, timestamp, text, err
+}
+
+func (c *slackClient) DeleteMessage(channelID, messageTimestamp string) (channel, timestamp string, err error) {
+	err = c.call("chat.delete", "", func() error {
+		channel, timestamp, err = c.api.DeleteMessage(channelID, messageTimestamp)
+		return err
+	})
+
+	return channel, timestamp, err
+}
+
+func (c *slackClient) GetUserInfo(userID string) (user *slack.User, err error) {
+	err = c.call("users.info", "", func() error {
+		user, err = c.api.GetUserInfo(userID)
+		return err
+	})
+
+	return user, err
+}
+
+func (c *slackClient) GetChannelInfo(channelID string) (channel *slack.Channel, err error) {
+	err = c.call("channels.info", "", func() error {
+		channel, err = c.api.GetChannelInfo(channelID)
+		return err
+	})
+
+	return channel, err
+}
+
+func (c *slackClient) GetChannels(excludeArchived bool) (channels []slack.Channel, err error) {
+	err = c.call("channels.list", "", func() error {
+		channels, err = c.api.GetChannels(excludeArchived)
+		return err
+	})
+
+	return channels, err
+}
+
+func (c *slackClient) JoinChannel(channelName string) (channel *slack.Channel, err error) {
+	err = c.call("channels.join", "", func() error {
+		channel, err = c.api.JoinChannel(channelName)
+		return err
+	})
+
+	return channel, err
+}
+
+func (c *slackClient) GetAccessLogs(params slack.AccessLogParameters) (logins []slack.Login, paging *slack.Paging, err error) {
+	err = c.call("team.accessLogs", "", func() error {
+		logins, paging, err = c.api.GetAccessLogs(params)
+		return err
+	})
+
+	return logins, paging, err
+}
+
+// call queues do to be run when method's rate limit allows, and waits for it.
+// Calls with different keys go in different queues, each allowed the full
+// rate. Most methods only need the one queue, so use an empty key.
+func (c *slackClient) call(method, key string, do func() error) error {
+	q := c.queue(method, key)
+	defer atomic.AddInt64(&q.depth, -1)
+
+	done := make(chan error, 1)
+	q.calls <- queuedCall{do: do, done: done}
+
+	return <-done
+}
+
+// queue returns the queue for calls to method with key, starting it if it
+// isn't running, and counts a call as waiting in it. The call is counted
+// before c.mu is let go so the queue can't be stopped for being idle in
+// between.
+func (c *slackClient) queue(method, key string) *callQueue {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := method
+	if key != "" {
+		name += "/" + key
+	}
+
+	q, ok := c.queues[name]
+	if !ok {
+		interval, ok := methodRates[method]
+		if !ok {
+			interval = rateTier3
+		}
+
+		q = &callQueue{
+			name:     name,
+			interval: interval,
+			idle:     callQueueIdle,
+			calls:    make(chan queuedCall, callQueueSize),
+		}
+		c.queues[name] = q
+
+		go c.run(q)
+	}
+
+	atomic.AddInt64(&q.depth, 1)
+
+	return q
+}
+
+// run runs q's calls until it's been idle for a while.
+func (c *slackClient) run(q *callQueue) {
+	for {
+		select {
+		case call := <-q.calls:
+			call.done <- q.attempt(call.do)
+		case <-time.After(q.idle):
+			if c.stopIdle(q) {
+				return
+			}
+		}
+	}
+}
+
+// stopIdle removes q if nothing is waiting in it, so the next call to its
+// method starts a new one, and reports whether it did.
+func (c *slackClient) stopIdle(q *callQueue) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if atomic.LoadInt64(&q.depth) > 0 {
+		return false
+	}
+
+	delete(c.queues, q.name)
+
+	return true
+}
+
+// A callQueue runs calls to one method, or one method in one channel, one at a
+// time, at most once per interval.
+type callQueue struct {
+	// calls waiting or in progress. Accessed atomically, so it goes first
+	// to be 64-bit aligned.
+	depth int64
+
+	name     string
+	interval time.Duration
+	idle     time.Duration
+	calls    chan queuedCall
+
+	// when the next call is allowed
+	next time.Time
+}
+
+type queuedCall struct {
+	do   func() error
+	done chan<- error
+}
+
+// attempt runs do, retrying it if Slack rate limits us or it fails for a
+// reason that might not happen again.
+func (q *callQueue) attempt(do func() error) error {
+	attempts, rateLimited := 0, 0
+	backoff := minCallBackoff
+
+	for {
+		time.Sleep(time.Until(q.next))
+
+		err := do()
+		q.next = time.Now().Add(q.interval)
+
+		if err == nil {
+			return nil
+		}
+
+		var limited *slack.RateLimitedError
+		if errors.As(err, &limited) {
+			rateLimited++
+			if rateLimited > maxRateLimitedRetries {
+				return err
+			}
+
+			log.Printf("slack rate limited %s, waiting %s", q.name, limited.RetryAfter)
+			q.next = time.Now().Add(limited.RetryAfter)
+			continue
+		}
+
+		attempts++
+		if attempts >= maxCallAttempts || !retryable(err) {
+			return err
+		}
+
+		log.Printf("error calling %s, retrying in %s: %v", q.name, backoff, err)
+		q.next = time.Now().Add(backoff)
+
+		backoff *= 2
+		if backoff > maxCallBackoff {
+			backoff = maxCallBackoff
+		}
+	}
+}
+
+// retryable reports whether err might not happen if the call was tried again,
+// eg. Slack having a 5xx or the network timing out.
+func retryable(err error) bool {
+	var r interface{ Retryable() bool }
+	if errors.As(err, &r) {
+		return r.Retryable()
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+
+	return false
+}
+
+// queueDepthHandler serves QueueDepths as JSON, for keeping an eye on how far
+// behind Slack we are.
+func queueDepthHandler(c *slackClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.QueueDepths())
+	})
+}
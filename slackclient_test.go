@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hackclub/streambot/slackfake"
+	"github.com/slack-go/slack"
+)
+
+// fastRateLimits makes the rate limits and backoffs tiny for the rest of the
+// test, since there's no point waiting on limits we're not really subject to.
+func fastRateLimits(t *testing.T) {
+	oldRates, oldMin, oldMax := methodRates, minCallBackoff, maxCallBackoff
+	t.Cleanup(func() {
+		methodRates, minCallBackoff, maxCallBackoff = oldRates, oldMin, oldMax
+	})
+
+	methodRates = map[string]time.Duration{}
+	for method := range oldRates {
+		methodRates[method] = time.Millisecond
+	}
+
+	minCallBackoff, maxCallBackoff = 10*time.Millisecond, 40*time.Millisecond
+}
+
+func newTestSlackClient(t *testing.T) (*slackClient, *slackfake.Server) {
+	fastRateLimits(t)
+
+	fake := slackfake.New()
+	t.Cleanup(fake.Close)
+
+	return newSlackClient(slack.New("xoxb-test", slack.OptionAPIURL(fake.URL))), fake
+}
+
+// waitFor polls cond until it's true, failing the test if it never is.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCallWaitsOutRateLimit(t *testing.T) {
+	c, fake := newTestSlackClient(t)
+
+	fake.Respond("chat.delete", func(values url.Values) interface{} {
+		if len(fake.Requests("chat.delete")) == 1 {
+			return slackfake.HTTPError{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"1"}}}
+		}
+
+		return map[string]interface{}{"ok": true, "channel": values.Get("channel"), "ts": values.Get("ts")}
+	})
+
+	start := time.Now()
+	if _, _, err := c.DeleteMessage("CGENERAL1", "1500000000.000001"); err != nil {
+		t.Fatal(err)
+	}
+
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("retried after %s, want the second Slack asked for", waited)
+	}
+	if calls := len(fake.Requests("chat.delete")); calls != 2 {
+		t.Errorf("called chat.delete %d times, want 2", calls)
+	}
+}
+
+func TestCallRetriesTransientErrors(t *testing.T) {
+	c, fake := newTestSlackClient(t)
+
+	fake.Respond("users.info", func(url.Values) interface{} {
+		return slackfake.HTTPError{StatusCode: http.StatusServiceUnavailable}
+	})
+
+	start := time.Now()
+	if _, err := c.GetUserInfo("UALICE001"); err == nil {
+		t.Fatal("got no error when Slack is down")
+	}
+
+	if calls := len(fake.Requests("users.info")); calls != maxCallAttempts {
+		t.Errorf("called users.info %d times, want %d", calls, maxCallAttempts)
+	}
+
+	// 10ms, 20ms, then 40ms twice
+	if waited := time.Since(start); waited < 110*time.Millisecond {
+		t.Errorf("gave up after %s, want it to have backed off between attempts", waited)
+	}
+}
+
+func TestCallDoesntRetryErrors(t *testing.T) {
+	c, fake := newTestSlackClient(t)
+
+	fake.Respond("users.info", func(url.Values) interface{} {
+		return map[string]interface{}{"ok": false, "error": "user_not_found"}
+	})
+
+	if _, err := c.GetUserInfo("UNOBODY01"); err == nil || err.Error() != "user_not_found" {
+		t.Errorf("got %v, want user_not_found", err)
+	}
+
+	if calls := len(fake.Requests("users.info")); calls != 1 {
+		t.Errorf("called users.info %d times, want 1", calls)
+	}
+}
+
+func TestPostMessageQueuesPerChannel(t *testing.T) {
+	c, fake := newTestSlackClient(t)
+
+	// posting in general hangs until it's let go
+	release := make(chan bool)
+	fake.Respond("chat.postMessage", func(values url.Values) interface{} {
+		if values.Get("channel") == "CGENERAL1" {
+			<-release
+		}
+
+		return map[string]interface{}{"ok": true, "channel": values.Get("channel"), "ts": "1500000000.000001"}
+	})
+
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, _, err := c.PostMessage("CGENERAL1", slack.MsgOptionText("hi", false))
+			done <- err
+		}()
+	}
+
+	waitFor(t, "both messages to general to be queued", func() bool {
+		return c.QueueDepths()["chat.postMessage/CGENERAL1"] == 2
+	})
+
+	posted := make(chan error, 1)
+	go func() {
+		_, _, err := c.PostMessage("CRANDOM01", slack.MsgOptionText("hi", false))
+		posted <- err
+	}()
+
+	select {
+	case err := <-posted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("posting in random waited on general")
+	}
+
+	depths := c.QueueDepths()
+	if depths["chat.postMessage/CGENERAL1"] != 2 || depths["chat.postMessage/CRANDOM01"] != 0 {
+		t.Errorf("got queue depths %v, want 2 in general and none in random", depths)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if depth := c.QueueDepths()["chat.postMessage/CGENERAL1"]; depth != 0 {
+		t.Errorf("general has %d calls queued after they all returned, want none", depth)
+	}
+}
+
+func TestIdleQueuesStop(t *testing.T) {
+	c, fake := newTestSlackClient(t)
+
+	oldIdle := callQueueIdle
+	t.Cleanup(func() { callQueueIdle = oldIdle })
+	callQueueIdle = 20 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.PostMessage("CGENERAL1", slack.MsgOptionText("hi", false)); err != nil {
+			t.Fatal(err)
+		}
+
+		waitFor(t, "general's queue to stop", func() bool {
+			_, ok := c.QueueDepths()["chat.postMessage/CGENERAL1"]
+			return !ok
+		})
+	}
+
+	if posted := len(fake.PostedMessages("CGENERAL1")); posted != 2 {
+		t.Errorf("posted %d messages, want 2 with the queue started again for the second", posted)
+	}
+}
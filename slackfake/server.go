@@ -0,0 +1,360 @@
+// Package slackfake is a stand-in for the parts of Slack's Web API streambot
+// uses. It records every request it gets and its responses can be scripted,
+// so streambot can be run against it without a real workspace.
+//
+// Point a client at it with slack.OptionAPIURL(server.URL).
+package slackfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/slack-go/slack"
+)
+
+// A Request is a call made to the fake API.
+type Request struct {
+	Method string
+	Values url.Values
+}
+
+// A Responder produces the JSON response to a call to an API method.
+type Responder func(values url.Values) interface{}
+
+// An HTTPError can be returned by a Responder to answer with an HTTP error
+// instead of JSON, eg. a 429 with a Retry-After header to rate limit the
+// client, or a 503 for an outage.
+type HTTPError struct {
+	StatusCode int
+	Header     http.Header
+}
+
+// Server is a fake Slack Web API.
+type Server struct {
+	// URL is the base API URL, ending in a slash.
+	URL string
+
+	server *httptest.Server
+
+	mu         sync.Mutex
+	requests   []Request
+	responders map[string]Responder
+
+	botUserID string
+	users     map[string]slack.User
+	channels  map[string]slack.Channel
+	logins    []slack.Login
+
+	// used to make up message timestamps
+	lastTs int
+}
+
+// New starts a fake Slack API on a local port. Call Close when done with it.
+func New() *Server {
+	s := &Server{
+		responders: map[string]Responder{},
+		botUserID:  "UBOT",
+		users:      map[string]slack.User{},
+		channels:   map[string]slack.Channel{},
+	}
+
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL + "/"
+
+	return s
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// SetBotUserID sets the user ID auth.test reports. It's "UBOT" by default.
+func (s *Server) SetBotUserID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.botUserID = id
+}
+
+// AddUser makes a user available from users.info.
+func (s *Server) AddUser(user slack.User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[user.ID] = user
+}
+
+// AddChannel makes a channel available from channels.info, channels.list and
+// channels.join.
+func (s *Server) AddChannel(channel slack.Channel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.channels[channel.ID] = channel
+}
+
+// AddLogin adds a login to what team.accessLogs returns.
+func (s *Server) AddLogin(login slack.Login) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.logins = append(s.logins, login)
+}
+
+// Respond overrides the response to an API method, eg. to make it fail.
+func (s *Server) Respond(method string, responder Responder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responders[method] = responder
+}
+
+// Requests returns every call made to the given API method so far, or to any
+// method if method is empty.
+func (s *Server) Requests(method string) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requests := []Request{}
+	for _, r := range s.requests {
+		if method == "" || r.Method == method {
+			requests = append(requests, r)
+		}
+	}
+
+	return requests
+}
+
+// PostedMessages returns the values of every chat.postMessage sent to
+// channel.
+func (s *Server) PostedMessages(channel string) []url.Values {
+	messages := []url.Values{}
+	for _, r := range s.Requests("chat.postMessage") {
+		if r.Values.Get("channel") == channel {
+			messages = append(messages, r.Values)
+		}
+	}
+
+	return messages
+}
+
+// Reset forgets every request recorded so far.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	method := strings.TrimPrefix(r.URL.Path, "/")
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{Method: method, Values: r.Form})
+	responder, ok := s.responders[method]
+	s.mu.Unlock()
+
+	if !ok {
+		responder, ok = s.defaultResponder(method)
+	}
+
+	var resp interface{}
+	if ok {
+		resp = responder(r.Form)
+	} else {
+		log.Println("slackfake: no response for", method)
+		resp = errorResponse("unknown_method")
+	}
+
+	if httpErr, ok := resp.(HTTPError); ok {
+		for name, values := range httpErr.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(httpErr.StatusCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println("slackfake: error encoding response:", err)
+	}
+}
+
+func (s *Server) defaultResponder(method string) (Responder, bool) {
+	switch method {
+	case "auth.test":
+		return s.authTest, true
+	case "chat.postMessage":
+		return s.postMessage, true
+	case "chat.update":
+		return s.updateMessage, true
+	case "chat.delete":
+		return s.deleteMessage, true
+	case "chat.postEphemeral":
+		return s.postEphemeral, true
+	case "users.info":
+		return s.userInfo, true
+	case "channels.info":
+		return s.channelInfo, true
+	case "channels.list":
+		return s.channelList, true
+	case "channels.join":
+		return s.joinChannel, true
+	case "team.accessLogs":
+		return s.accessLogs, true
+	default:
+		return nil, false
+	}
+}
+
+func errorResponse(err string) map[string]interface{} {
+	return map[string]interface{}{
+		"ok":    false,
+		"error": err,
+	}
+}
+
+// nextTs makes up a unique message timestamp.
+func (s *Server) nextTs() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastTs++
+
+	return fmt.Sprintf("1500000000.%06d", s.lastTs)
+}
+
+func (s *Server) authTest(values url.Values) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return map[string]interface{}{
+		"ok":      true,
+		"user_id": s.botUserID,
+		"user":    "streambot",
+	}
+}
+
+func (s *Server) postMessage(values url.Values) interface{} {
+	return map[string]interface{}{
+		"ok":      true,
+		"channel": values.Get("channel"),
+		"ts":      s.nextTs(),
+	}
+}
+
+func (s *Server) updateMessage(values url.Values) interface{} {
+	return map[string]interface{}{
+		"ok":      true,
+		"channel": values.Get("channel"),
+		"ts":      values.Get("ts"),
+		"text":    values.Get("text"),
+	}
+}
+
+func (s *Server) deleteMessage(values url.Values) interface{} {
+	return map[string]interface{}{
+		"ok":      true,
+		"channel": values.Get("channel"),
+		"ts":      values.Get("ts"),
+	}
+}
+
+func (s *Server) postEphemeral(values url.Values) interface{} {
+	return map[string]interface{}{
+		"ok":         true,
+		"message_ts": s.nextTs(),
+	}
+}
+
+func (s *Server) userInfo(values url.Values) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[values.Get("user")]
+	if !ok {
+		return errorResponse("user_not_found")
+	}
+
+	return map[string]interface{}{
+		"ok":   true,
+		"user": user,
+	}
+}
+
+func (s *Server) channelInfo(values url.Values) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channel, ok := s.channels[values.Get("channel")]
+	if !ok {
+		return errorResponse("channel_not_found")
+	}
+
+	return map[string]interface{}{
+		"ok":      true,
+		"channel": channel,
+	}
+}
+
+func (s *Server) channelList(values url.Values) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := []slack.Channel{}
+	for _, channel := range s.channels {
+		channels = append(channels, channel)
+	}
+
+	return map[string]interface{}{
+		"ok":       true,
+		"channels": channels,
+	}
+}
+
+func (s *Server) joinChannel(values url.Values) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := strings.TrimPrefix(values.Get("name"), "#")
+	for _, channel := range s.channels {
+		if channel.Name == name {
+			return map[string]interface{}{
+				"ok":      true,
+				"channel": channel,
+			}
+		}
+	}
+
+	return errorResponse("channel_not_found")
+}
+
+func (s *Server) accessLogs(values url.Values) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	logins := append([]slack.Login{}, s.logins...)
+
+	return map[string]interface{}{
+		"ok":     true,
+		"logins": logins,
+		"paging": slack.Paging{
+			Count: len(logins),
+			Total: len(logins),
+			Page:  1,
+			Pages: 1,
+		},
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// Slack never sends requests anywhere near this big.
+const maxSlackRequestSize = 64 * 1024
+
+// slashCommandHandler serves Slack slash commands like `/streambot disable
+// channel`. Replies are ephemeral so commands don't clutter up channels.
+func slashCommandHandler(signingSecret string, commands *commandRouter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := verifySlackRequest(signingSecret, r)
+		if err != nil {
+			log.Println("rejecting slash command:", err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		cmd, err := slack.SlashCommandParse(r)
+		if err != nil {
+			log.Println("error parsing slash command:", err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(slashCommandReply(commands, cmd))
+	})
+}
+
+// slashCommandReply runs a slash command and returns the ephemeral response
+// to it.
+func slashCommandReply(commands *commandRouter, cmd slack.SlashCommand) slack.Msg {
+	reply := commands.Dispatch(commandRequest{
+		User:    cmd.UserID,
+		Channel: cmd.ChannelID,
+		Args:    tokenize(cmd.Text),
+		Source:  strings.TrimSpace(cmd.Command + " " + cmd.Text),
+	})
+
+	return slack.Msg{
+		ResponseType: slack.ResponseTypeEphemeral,
+		Text:         reply,
+	}
+}
+
+// verifySlackRequest checks that r was signed with our signing secret and
+// returns its body.
+func verifySlackRequest(signingSecret string, r *http.Request) ([]byte, error) {
+	verifier, err := slack.NewSecretsVerifier(r.Header, signingSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSlackRequestSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := verifier.Write(body); err != nil {
+		return nil, err
+	}
+
+	if err := verifier.Ensure(); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/slack-go/slack"
+)
+
+const (
+	// Slack pings socket mode connections every few seconds. If we hear
+	// nothing for this long the connection is dead.
+	socketModeReadTimeout  = 60 * time.Second
+	socketModeWriteTimeout = 10 * time.Second
+
+	socketModeMinBackoff = 1 * time.Second
+	socketModeMaxBackoff = 2 * time.Minute
+
+	// how long asking Slack for a connection can take before we give up and
+	// try again
+	socketModeOpenTimeout = 30 * time.Second
+)
+
+var socketModeHTTPClient = &http.Client{Timeout: socketModeOpenTimeout}
+
+// socketModeClient receives events from Slack over a Socket Mode websocket, so
+// streambot doesn't need a public HTTP endpoint. Events are sent on events in
+// the same form RTM delivers them, and slash commands are answered in the
+// acknowledgement. streambot never sends anything interactive, so interactive
+// payloads are acknowledged and otherwise ignored.
+type socketModeClient struct {
+	appToken  string
+	apiURL    string
+	botUserID string
+
+	commands *commandRouter
+	events   chan<- slack.RTMEvent
+}
+
+// A socketModeEnvelope wraps everything Slack sends over Socket Mode.
+type socketModeEnvelope struct {
+	EnvelopeID string          `json:"envelope_id"`
+	Type       string          `json:"type"`
+	Reason     string          `json:"reason"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+type socketModeAck struct {
+	EnvelopeID string      `json:"envelope_id"`
+	Payload    interface{} `json:"payload,omitempty"`
+}
+
+func newSocketModeClient(appToken, apiURL, botUserID string, commands *commandRouter, events chan<- slack.RTMEvent) *socketModeClient {
+	return &socketModeClient{
+		appToken:  appToken,
+		apiURL:    apiURL,
+		botUserID: botUserID,
+		commands:  commands,
+		events:    events,
+	}
+}
+
+// Run connects to Slack and handles events forever, reconnecting whenever the
+// connection drops.
+func (c *socketModeClient) Run() {
+	backoff := socketModeMinBackoff
+
+	for {
+		start := time.Now()
+
+		err := c.connectAndServe()
+		if err == nil {
+			backoff = socketModeMinBackoff
+			continue
+		}
+
+		log.Println("socket mode connection lost:", err)
+
+		// connections that lasted a while were healthy, so start backing off
+		// from scratch
+		if time.Since(start) > socketModeMaxBackoff {
+			backoff = socketModeMinBackoff
+		}
+
+		fmt.Println("reconnecting to socket mode in", backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > socketModeMaxBackoff {
+			backoff = socketModeMaxBackoff
+		}
+	}
+}
+
+// connectAndServe handles one socket mode connection until it closes. Slack
+// asking us to reconnect is not an error.
+func (c *socketModeClient) connectAndServe() error {
+	wsURL, err := c.openConnection()
+	if err != nil {
+		return err
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(socketModeReadTimeout))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(socketModeReadTimeout))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(socketModeWriteTimeout))
+	})
+
+	for {
+		var envelope socketModeEnvelope
+		if err := conn.ReadJSON(&envelope); err != nil {
+			return err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(socketModeReadTimeout))
+
+		switch envelope.Type {
+		case "hello":
+			fmt.Println("connected to socket mode")
+		case "disconnect":
+			fmt.Println("socket mode asked us to reconnect:", envelope.Reason)
+			return nil
+		case "events_api":
+			if err := c.ack(conn, envelope.EnvelopeID, nil); err != nil {
+				return err
+			}
+
+			var callback struct {
+				Event json.RawMessage `json:"event"`
+			}
+			if err := json.Unmarshal(envelope.Payload, &callback); err != nil {
+				log.Println("error parsing socket mode event:", err)
+				continue
+			}
+
+			if ev, ok := parseEventsAPIEvent(callback.Event, c.botUserID); ok {
+				c.events <- ev
+			}
+		case "slash_commands":
+			var cmd slack.SlashCommand
+			if err := json.Unmarshal(envelope.Payload, &cmd); err != nil {
+				log.Println("error parsing socket mode slash command:", err)
+				if err := c.ack(conn, envelope.EnvelopeID, nil); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := c.ack(conn, envelope.EnvelopeID, slashCommandReply(c.commands, cmd)); err != nil {
+				return err
+			}
+		case "interactive":
+			// streambot doesn't send anything interactive, but Slack still
+			// expects every envelope to be acknowledged
+			var callback slack.InteractionCallback
+			if err := json.Unmarshal(envelope.Payload, &callback); err != nil {
+				log.Println("error parsing socket mode interaction:", err)
+			} else {
+				fmt.Println("ignoring interaction of type", callback.Type, "from", callback.User.ID)
+			}
+
+			if err := c.ack(conn, envelope.EnvelopeID, nil); err != nil {
+				return err
+			}
+		default:
+			log.Println("ignoring socket mode message of type", envelope.Type)
+
+			if envelope.EnvelopeID != "" {
+				if err := c.ack(conn, envelope.EnvelopeID, nil); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (c *socketModeClient) ack(conn *websocket.Conn, envelopeID string, payload interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(socketModeWriteTimeout))
+	return conn.WriteJSON(socketModeAck{
+		EnvelopeID: envelopeID,
+		Payload:    payload,
+	})
+}
+
+// openConnection asks Slack for a socket mode websocket URL.
+func (c *socketModeClient) openConnection() (string, error) {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.apiURL, "/")+"/apps.connections.open", nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.appToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := socketModeHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		slack.SlackResponse
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding apps.connections.open response: %w", err)
+	}
+
+	if !body.Ok {
+		return "", errors.New("apps.connections.open: " + body.Error)
+	}
+
+	return body.URL, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hackclub/streambot/slackfake"
+	"github.com/slack-go/slack"
+)
+
+// newFakeSocketMode starts a fake Slack whose apps.connections.open hands out
+// a websocket that sends every connection made to it on the returned channel.
+func newFakeSocketMode(t *testing.T) (*slackfake.Server, <-chan *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 10)
+
+	upgrader := websocket.Upgrader{}
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		conns <- conn
+	}))
+	t.Cleanup(ws.Close)
+
+	fake := slackfake.New()
+	t.Cleanup(fake.Close)
+
+	fake.Respond("apps.connections.open", func(url.Values) interface{} {
+		return map[string]interface{}{"ok": true, "url": "ws" + strings.TrimPrefix(ws.URL, "http")}
+	})
+
+	return fake, conns
+}
+
+func nextConn(t *testing.T, conns <-chan *websocket.Conn) *websocket.Conn {
+	select {
+	case conn := <-conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("socket mode client never connected")
+		return nil
+	}
+}
+
+func readAck(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var ack map[string]interface{}
+	if err := conn.ReadJSON(&ack); err != nil {
+		t.Fatal("reading ack:", err)
+	}
+
+	return ack
+}
+
+func TestSocketModeAcksEvents(t *testing.T) {
+	fake, conns := newFakeSocketMode(t)
+	events := make(chan slack.RTMEvent, 10)
+	c := newSocketModeClient("xapp-test", fake.URL, "UBOT", streambotCommands(NewMemoryConfig(time.Hour)), events)
+
+	done := make(chan error, 1)
+	go func() { done <- c.connectAndServe() }()
+
+	conn := nextConn(t, conns)
+	conn.WriteJSON(map[string]interface{}{"type": "hello"})
+	conn.WriteJSON(map[string]interface{}{
+		"envelope_id": "env-1",
+		"type":        "events_api",
+		"payload": map[string]interface{}{
+			"event": map[string]interface{}{"type": "message", "user": "UALICE001", "channel": "CGENERAL1", "text": "hi"},
+		},
+	})
+
+	if ack := readAck(t, conn); ack["envelope_id"] != "env-1" {
+		t.Errorf("got ack %v, want one for env-1", ack)
+	}
+
+	select {
+	case ev := <-events:
+		if msg, ok := ev.Data.(*slack.MessageEvent); !ok || msg.Text != "hi" {
+			t.Errorf("got event %+v, want the message", ev.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("never got the event")
+	}
+
+	conn.WriteJSON(map[string]interface{}{"envelope_id": "env-2", "type": "interactive", "payload": map[string]interface{}{"type": "block_actions"}})
+	if ack := readAck(t, conn); ack["envelope_id"] != "env-2" {
+		t.Errorf("got ack %v, want one for the interaction", ack)
+	}
+
+	conn.WriteJSON(map[string]interface{}{"type": "disconnect", "reason": "refresh_requested"})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("disconnect returned %v, want nil so Run reconnects straight away", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't stop after disconnect")
+	}
+}
+
+func TestSocketModeSlashCommands(t *testing.T) {
+	fake, conns := newFakeSocketMode(t)
+	c := newSocketModeClient("xapp-test", fake.URL, "UBOT", streambotCommands(NewMemoryConfig(time.Hour)), make(chan slack.RTMEvent, 1))
+
+	go c.connectAndServe()
+
+	conn := nextConn(t, conns)
+	conn.WriteJSON(map[string]interface{}{
+		"envelope_id": "env-1",
+		"type":        "slash_commands",
+		"payload":     map[string]interface{}{"command": "/streambot", "text": "status me", "user_id": "UALICE001", "channel_id": "CGENERAL1"},
+	})
+
+	ack := readAck(t, conn)
+	payload, _ := ack["payload"].(map[string]interface{})
+	if ack["envelope_id"] != "env-1" || payload["text"] != "i am streaming your messages" || payload["response_type"] != "ephemeral" {
+		t.Errorf("got ack %v, want the status reply", ack)
+	}
+}
+
+func TestSocketModeReconnects(t *testing.T) {
+	fake, conns := newFakeSocketMode(t)
+	c := newSocketModeClient("xapp-test", fake.URL, "UBOT", streambotCommands(NewMemoryConfig(time.Hour)), make(chan slack.RTMEvent, 1))
+
+	// Run never returns, so it's left trying to reconnect to a closed
+	// server once the test is done
+	go c.Run()
+
+	// Slack asking us to reconnect
+	conn := nextConn(t, conns)
+	conn.WriteJSON(map[string]interface{}{"type": "disconnect", "reason": "refresh_requested"})
+
+	// the connection dropping
+	conn = nextConn(t, conns)
+	conn.Close()
+
+	nextConn(t, conns)
+
+	if opens := len(fake.Requests("apps.connections.open")); opens != 3 {
+		t.Errorf("opened %d connections, want 3", opens)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+var (
+	// how long someone counts as typing after Slack last said they were.
+	// Slack repeats user_typing every few seconds while they keep going.
+	typingTimeout = 6 * time.Second
+
+	// how often the status message can be edited at most
+	typingUpdatePeriod = 2 * time.Second
+)
+
+// typingStatus keeps one message in the stream channel listing who's typing
+// where. It's edited as people start and stop typing, at most once every
+// typingUpdatePeriod, and deleted when nobody is.
+type typingStatus struct {
+	api      *slackClient
+	metadata *slackMetadata
+	channel  string
+
+	// typingTimeout and typingUpdatePeriod when it was made
+	timeout      time.Duration
+	updatePeriod time.Duration
+
+	mu sync.Mutex
+
+	// when each user was last seen typing in each channel, by channel name
+	// then user name
+	typing map[string]map[string]time.Time
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newTypingStatus(api *slackClient, metadata *slackMetadata, channel string) *typingStatus {
+	return &typingStatus{
+		api:          api,
+		metadata:     metadata,
+		channel:      channel,
+		timeout:      typingTimeout,
+		updatePeriod: typingUpdatePeriod,
+		typing:       map[string]map[string]time.Time{},
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+}
+
+// Add records that ev's user is typing.
+func (t *typingStatus) Add(ev Event) error {
+	user, err := t.metadata.User(ev.User)
+	if err != nil {
+		return err
+	}
+
+	channelName := ""
+
+	if strings.HasPrefix(ev.Channel, "D") {
+		channelName = "a DM with streambot"
+	} else {
+		channel, err := t.metadata.Channel(ev.Channel)
+		if err != nil {
+			return err
+		}
+
+		channelName = "#" + channel.Name
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	users, ok := t.typing[channelName]
+	if !ok {
+		users = map[string]time.Time{}
+		t.typing[channelName] = users
+	}
+
+	users[user.Name] = time.Now()
+
+	return nil
+}
+
+// Run keeps the status message up to date until Stop is called.
+func (t *typingStatus) Run() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(t.updatePeriod)
+	defer ticker.Stop()
+
+	// the status message, if there is one, and what it says
+	var timestamp, text string
+
+	for {
+		select {
+		case <-ticker.C:
+			newText := t.text(time.Now())
+			if newText == text {
+				continue
+			}
+
+			var err error
+
+			switch {
+			case newText == "":
+				if _, _, err = t.api.DeleteMessage(t.channel, timestamp); err == nil {
+					timestamp = ""
+				}
+			case timestamp == "":
+				_, timestamp, err = t.api.PostMessage(t.channel, slack.MsgOptionText(newText, false), slack.MsgOptionAsUser(true))
+			default:
+				_, _, _, err = t.api.UpdateMessage(t.channel, timestamp, slack.MsgOptionText(newText, false), slack.MsgOptionAsUser(true))
+			}
+
+			if err != nil && messageGone(err) {
+				// someone deleted it, so start over with a new one
+				timestamp, text = "", ""
+				continue
+			}
+
+			if err != nil {
+				log.Println("error updating typing status:", err)
+				continue
+			}
+
+			text = newText
+		case <-t.stop:
+			if timestamp != "" {
+				if _, _, err := t.api.DeleteMessage(t.channel, timestamp); err != nil {
+					log.Println("error clearing typing status:", err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// Stop clears the status message and waits for Run to finish.
+func (t *typingStatus) Stop() {
+	close(t.stop)
+	<-t.stopped
+}
+
+// text forgets anyone who stopped typing before now and describes who's
+// left, one line per channel, or returns "" if nobody is typing.
+func (t *typingStatus) text(now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	channelNames := []string{}
+	for channelName := range t.typing {
+		channelNames = append(channelNames, channelName)
+	}
+
+	sort.Strings(channelNames)
+
+	lines := []string{}
+
+	for _, channelName := range channelNames {
+		users := t.typing[channelName]
+
+		names := []string{}
+		for name, seen := range users {
+			if now.Sub(seen) > t.timeout {
+				delete(users, name)
+				continue
+			}
+
+			names = append(names, name)
+		}
+
+		if len(names) == 0 {
+			delete(t.typing, channelName)
+			continue
+		}
+
+		sort.Strings(names)
+
+		verb := " is typing in "
+		if len(names) > 1 {
+			verb = " are typing in "
+		}
+
+		lines = append(lines, "_"+joinNames(names)+verb+channelName+"…_")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// messageGone reports whether err from editing or deleting a message means it
+// doesn't exist anymore. The slack package doesn't have an error type for
+// Slack's error codes, it just makes an error out of the code, so look for
+// it in the message in case something along the way wrapped it.
+func messageGone(err error) bool {
+	return strings.Contains(err.Error(), "message_not_found")
+}
+
+// joinNames lists names like "a, b and c".
+func joinNames(names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
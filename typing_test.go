@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hackclub/streambot/slackfake"
+)
+
+// newTestTyping starts a typingStatus that updates quickly and forgets typists
+// after a fraction of a second.
+func newTestTyping(t *testing.T) (*typingStatus, *slackfake.Server) {
+	b, fake, _ := newTestBot(t)
+
+	oldTimeout, oldPeriod := typingTimeout, typingUpdatePeriod
+	t.Cleanup(func() {
+		typingTimeout, typingUpdatePeriod = oldTimeout, oldPeriod
+	})
+	typingTimeout, typingUpdatePeriod = 150*time.Millisecond, 20*time.Millisecond
+
+	typing := newTypingStatus(b.api, b.metadata, testStreamChannel)
+	go typing.Run()
+	t.Cleanup(typing.Stop)
+
+	return typing, fake
+}
+
+func addTyping(t *testing.T, typing *typingStatus, userId, channelId string) {
+	if err := typing.Add(Event{Type: "user_typing", User: userId, Channel: channelId}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTypingCombinesTypists(t *testing.T) {
+	typing, fake := newTestTyping(t)
+
+	addTyping(t, typing, "UALICE001", "CGENERAL1")
+	addTyping(t, typing, "UBOB00001", "CGENERAL1")
+	addTyping(t, typing, "UALICE001", "CRANDOM01")
+
+	waitFor(t, "the typing status", func() bool {
+		return len(fake.PostedMessages(testStreamChannel)) > 0
+	})
+
+	want := "_alice and bob are typing in #general…_\n_alice is typing in #random…_"
+	if got := fake.PostedMessages(testStreamChannel)[0].Get("text"); got != want {
+		t.Errorf("posted %q, want %q", got, want)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if posted := len(fake.PostedMessages(testStreamChannel)); posted != 1 {
+		t.Errorf("posted %d messages, want them all in one", posted)
+	}
+}
+
+func TestTypingUpdatesThenDeletes(t *testing.T) {
+	typing, fake := newTestTyping(t)
+
+	addTyping(t, typing, "UALICE001", "CGENERAL1")
+	waitFor(t, "the typing status", func() bool {
+		return len(fake.PostedMessages(testStreamChannel)) > 0
+	})
+
+	addTyping(t, typing, "UBOB00001", "CGENERAL1")
+	waitFor(t, "the typing status to be updated", func() bool {
+		return len(fake.Requests("chat.update")) > 0
+	})
+
+	// the fake's first message is always this one
+	ts := "1500000000.000001"
+
+	update := fake.Requests("chat.update")[0].Values
+	if update.Get("ts") != ts || update.Get("text") != "_alice and bob are typing in #general…_" {
+		t.Errorf("updated %s to %q, want %s to list alice and bob", update.Get("ts"), update.Get("text"), ts)
+	}
+
+	// nobody types for a while
+	waitFor(t, "the typing status to be deleted", func() bool {
+		return len(fake.Requests("chat.delete")) > 0
+	})
+
+	if deleted := fake.Requests("chat.delete")[0].Values.Get("ts"); deleted != ts {
+		t.Errorf("deleted %s, want the status message %s", deleted, ts)
+	}
+	if posted := len(fake.PostedMessages(testStreamChannel)); posted != 1 {
+		t.Errorf("posted %d messages, want 1 that was updated", posted)
+	}
+}
+
+func TestTypingRepostsDeletedMessage(t *testing.T) {
+	typing, fake := newTestTyping(t)
+
+	// someone deleted the status message
+	fake.Respond("chat.update", func(url.Values) interface{} {
+		return map[string]interface{}{"ok": false, "error": "message_not_found"}
+	})
+
+	addTyping(t, typing, "UALICE001", "CGENERAL1")
+	waitFor(t, "the typing status", func() bool {
+		return len(fake.PostedMessages(testStreamChannel)) > 0
+	})
+
+	addTyping(t, typing, "UBOB00001", "CGENERAL1")
+	waitFor(t, "a new typing status", func() bool {
+		return len(fake.PostedMessages(testStreamChannel)) > 1
+	})
+
+	if updates := len(fake.Requests("chat.update")); updates != 1 {
+		t.Errorf("tried updating %d times, want 1 before giving up on the old message", updates)
+	}
+	if got := fake.PostedMessages(testStreamChannel)[1].Get("text"); got != "_alice and bob are typing in #general…_" {
+		t.Errorf("reposted %q, want alice and bob", got)
+	}
+}
@@ -0,0 +1,171 @@
+package ws
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Clients that can't put a token in the URL can offer it as a websocket
+// subprotocol instead, as tokenProtocolPrefix followed by the token.
+const tokenProtocolPrefix = "token."
+
+// Auth decides who's allowed to connect.
+type Auth struct {
+	// AllowedOrigins lists the origins browsers may connect from, eg.
+	// "https://hackclub.com". A "*." at the start of the host allows any
+	// subdomain, eg. "https://*.hackclub.com". If it's empty any origin is
+	// allowed. Requests without an Origin header don't come from browsers and
+	// aren't checked.
+	AllowedOrigins []string
+
+	// TokenSecret, if set, requires clients to present a token made with it
+	// by NewToken.
+	TokenSecret []byte
+}
+
+var (
+	errForbiddenOrigin = errors.New("origin not allowed")
+	errMissingToken    = errors.New("missing token")
+	errInvalidToken    = errors.New("invalid token")
+	errExpiredToken    = errors.New("token expired")
+)
+
+// NewToken makes an access token that expires after ttl.
+func NewToken(secret []byte, ttl time.Duration) string {
+	expiry := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+
+	return expiry + "." + tokenSignature(secret, expiry)
+}
+
+// VerifyToken checks that token was made with secret and hasn't expired.
+func VerifyToken(secret []byte, token string) error {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return errInvalidToken
+	}
+
+	expiry, signature := parts[0], parts[1]
+
+	if !hmac.Equal([]byte(signature), []byte(tokenSignature(secret, expiry))) {
+		return errInvalidToken
+	}
+
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return errInvalidToken
+	}
+
+	if time.Now().Unix() > expiresAt {
+		return errExpiredToken
+	}
+
+	return nil
+}
+
+func tokenSignature(secret []byte, expiry string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(expiry))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// check decides whether r may connect. If not, it returns the HTTP status to
+// reject it with. Otherwise it returns the subprotocol to accept, if any.
+func (a Auth) check(r *http.Request) (protocol string, status int, err error) {
+	if !a.originAllowed(r.Header.Get("Origin")) {
+		return "", http.StatusForbidden, errForbiddenOrigin
+	}
+
+	if len(a.TokenSecret) == 0 {
+		return "", http.StatusOK, nil
+	}
+
+	token := r.URL.Query().Get("token")
+
+	for _, p := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(p, tokenProtocolPrefix) {
+			// browsers insist we accept one of the subprotocols they offered
+			protocol = p
+
+			if token == "" {
+				token = strings.TrimPrefix(p, tokenProtocolPrefix)
+			}
+		}
+	}
+
+	if token == "" {
+		return "", http.StatusUnauthorized, errMissingToken
+	}
+
+	if err := VerifyToken(a.TokenSecret, token); err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+
+	return protocol, http.StatusOK, nil
+}
+
+// Require wraps h so it only serves requests a allows, eg. for endpoints that
+// aren't for everyone. Outside of websockets the token goes in the "token"
+// query parameter.
+func (a Auth) Require(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, status, err := a.check(r); err != nil {
+			log.Printf("rejecting request for %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (a Auth) originAllowed(origin string) bool {
+	if len(a.AllowedOrigins) == 0 || origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range a.AllowedOrigins {
+		if originMatches(allowed, u) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// originMatches reports whether origin is allowed by pattern, which may leave
+// out the scheme and may start its host with a "*." wildcard.
+func originMatches(pattern string, origin *url.URL) bool {
+	scheme, host := "", pattern
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		scheme, host = pattern[:i], pattern[i+3:]
+	}
+
+	if scheme != "" && !strings.EqualFold(scheme, origin.Scheme) {
+		return false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "/"))
+	originHost := strings.ToLower(origin.Host)
+
+	if strings.HasPrefix(host, "*.") {
+		return strings.HasSuffix(originHost, host[1:])
+	}
+
+	return originHost == host
+}
@@ -0,0 +1,145 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyToken(t *testing.T) {
+	secret := []byte("secret")
+	valid := NewToken(secret, time.Hour)
+	expiry := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	expired := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+
+	// flip the last character of the signature
+	tampered := valid[:len(valid)-1] + "A"
+	if tampered == valid {
+		tampered = valid[:len(valid)-1] + "B"
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", valid, nil},
+		{"expired", expired + "." + tokenSignature(secret, expired), errExpiredToken},
+		{"tampered signature", tampered, errInvalidToken},
+		{"tampered expiry", "9" + valid, errInvalidToken},
+		{"other secret", NewToken([]byte("other"), time.Hour), errInvalidToken},
+		{"no signature", expiry, errInvalidToken},
+		{"empty signature", expiry + ".", errInvalidToken},
+		{"empty", "", errInvalidToken},
+		{"expiry not a number", "soon." + tokenSignature(secret, "soon"), errInvalidToken},
+	}
+
+	for _, test := range tests {
+		if err := VerifyToken(secret, test.token); err != test.want {
+			t.Errorf("%s: VerifyToken(%q) = %v, want %v", test.name, test.token, err, test.want)
+		}
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{nil, "https://anywhere.com", true},
+		{[]string{"https://hackclub.com"}, "", true},
+		{[]string{"https://hackclub.com"}, "https://hackclub.com", true},
+		{[]string{"https://hackclub.com"}, "https://HackClub.com", true},
+		{[]string{"https://hackclub.com/"}, "https://hackclub.com", true},
+		{[]string{"https://hackclub.com"}, "http://hackclub.com", false},
+		{[]string{"https://hackclub.com"}, "https://hackclub.com:8443", false},
+		{[]string{"https://hackclub.com"}, "https://evil.com", false},
+		{[]string{"https://hackclub.com"}, "https://hackclub.com.evil.com", false},
+		{[]string{"http://localhost:3000"}, "http://localhost:3000", true},
+		{[]string{"http://localhost:3000"}, "http://localhost:4000", false},
+		{[]string{"hackclub.com"}, "http://hackclub.com", true},
+		{[]string{"hackclub.com"}, "https://hackclub.com", true},
+		{[]string{"https://*.hackclub.com"}, "https://streambot.hackclub.com", true},
+		{[]string{"https://*.hackclub.com"}, "https://a.b.hackclub.com", true},
+		{[]string{"https://*.hackclub.com"}, "https://hackclub.com", false},
+		{[]string{"https://*.hackclub.com"}, "https://evilhackclub.com", false},
+		{[]string{"https://*.hackclub.com"}, "http://streambot.hackclub.com", false},
+		{[]string{"https://*.hackclub.com"}, "https://streambot.hackclub.com:8443", false},
+		{[]string{"*.hackclub.com"}, "http://streambot.hackclub.com", true},
+		{[]string{"https://evil.com", "https://hackclub.com"}, "https://hackclub.com", true},
+		{[]string{"https://hackclub.com"}, "://bad origin", false},
+	}
+
+	for _, test := range tests {
+		a := Auth{AllowedOrigins: test.allowed}
+		if got := a.originAllowed(test.origin); got != test.want {
+			t.Errorf("originAllowed(%q) with %q = %v, want %v", test.origin, test.allowed, got, test.want)
+		}
+	}
+}
+
+func TestAuthCheck(t *testing.T) {
+	secret := []byte("secret")
+	token := NewToken(secret, time.Hour)
+	a := Auth{AllowedOrigins: []string{"https://hackclub.com"}, TokenSecret: secret}
+
+	tests := []struct {
+		name         string
+		url          string
+		origin       string
+		protocols    []string
+		wantProtocol string
+		wantStatus   int
+	}{
+		{"query token", "/?token=" + token, "https://hackclub.com", nil, "", http.StatusOK},
+		{"protocol token", "/", "https://hackclub.com", []string{tokenProtocolPrefix + token}, tokenProtocolPrefix + token, http.StatusOK},
+		{"no origin", "/?token=" + token, "", nil, "", http.StatusOK},
+		{"bad origin", "/?token=" + token, "https://evil.com", nil, "", http.StatusForbidden},
+		{"missing token", "/", "https://hackclub.com", nil, "", http.StatusUnauthorized},
+		{"bad token", "/?token=nope", "https://hackclub.com", nil, "", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.url, nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.protocols != nil {
+			r.Header.Set("Sec-WebSocket-Protocol", strings.Join(test.protocols, ", "))
+		}
+
+		protocol, status, _ := a.check(r)
+		if protocol != test.wantProtocol || status != test.wantStatus {
+			t.Errorf("%s: check = %q, %d, want %q, %d", test.name, protocol, status, test.wantProtocol, test.wantStatus)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	secret := []byte("secret")
+	h := Auth{TokenSecret: secret}.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"/debug?token=" + NewToken(secret, time.Hour), http.StatusOK},
+		{"/debug", http.StatusUnauthorized},
+		{"/debug?token=" + NewToken([]byte("other"), time.Hour), http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.url, nil))
+
+		if w.Code != test.want {
+			t.Errorf("GET %s = %d, want %d", test.url, w.Code, test.want)
+		}
+	}
+}
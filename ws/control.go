@@ -0,0 +1,145 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Most types or channels a single subscription can list.
+	maxFilterEntries = 50
+
+	// Longest type or channel name a subscription can list.
+	maxFilterEntryLength = 100
+
+	// Longest ping payload we'll echo back.
+	maxPingLength = 64
+)
+
+// controlMessage is the only thing clients are allowed to send us. Exactly one
+// field must be set:
+//
+//	{"subscribe": {"types": ["message"], "channels": ["#ship"]}}
+//	{"ping": "anything"}
+//	{"resume": {"since": 1234}}
+type controlMessage struct {
+	Subscribe *Filter        `json:"subscribe,omitempty"`
+	Ping      *string        `json:"ping,omitempty"`
+	Resume    *resumeRequest `json:"resume,omitempty"`
+}
+
+type resumeRequest struct {
+	Since uint64 `json:"since"`
+}
+
+// controlReply is what we send back to a client in response to a control
+// message, as opposed to activity.
+type controlReply struct {
+	Pong  *string      `json:"pong,omitempty"`
+	Error string       `json:"error,omitempty"`
+	Reset *resetNotice `json:"reset,omitempty"`
+}
+
+// resetNotice tells a resuming client we can't send everything it missed,
+// either because it's older than the history we keep or because its sequence
+// number is from before streambot restarted. It should throw away what it has
+// and carry on from Seq. The usual recent activity follows it.
+//
+//	{"reset": {"seq": 5678, "reason": "missed activity is no longer kept"}}
+type resetNotice struct {
+	Seq    uint64 `json:"seq"`
+	Reason string `json:"reason"`
+}
+
+// A resumption is a request from a client for the activity it missed.
+type resumption struct {
+	client *Client
+	since  uint64
+}
+
+// A reply is a controlReply on its way to the client that asked for it.
+type reply struct {
+	client *Client
+	data   []byte
+}
+
+// parseControlMessage decodes and validates a frame from a client.
+func parseControlMessage(data []byte) (controlMessage, error) {
+	var msg controlMessage
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&msg); err != nil {
+		return msg, fmt.Errorf("invalid control message: %v", err)
+	}
+
+	if dec.More() {
+		return msg, errors.New("invalid control message: trailing data")
+	}
+
+	set := 0
+	if msg.Subscribe != nil {
+		set++
+	}
+	if msg.Ping != nil {
+		set++
+	}
+	if msg.Resume != nil {
+		set++
+	}
+
+	if set != 1 {
+		return msg, errors.New("control message must have exactly one of subscribe, ping or resume")
+	}
+
+	if msg.Subscribe != nil {
+		if err := validateFilter(*msg.Subscribe); err != nil {
+			return msg, err
+		}
+	}
+
+	if msg.Ping != nil && len(*msg.Ping) > maxPingLength {
+		return msg, fmt.Errorf("ping can be at most %d bytes", maxPingLength)
+	}
+
+	return msg, nil
+}
+
+func validateFilter(f Filter) error {
+	if err := validateFilterEntries("types", f.Types); err != nil {
+		return err
+	}
+
+	return validateFilterEntries("channels", f.Channels)
+}
+
+func validateFilterEntries(name string, entries []string) error {
+	if len(entries) > maxFilterEntries {
+		return fmt.Errorf("filters can list at most %d %s", maxFilterEntries, name)
+	}
+
+	for _, e := range entries {
+		if e == "" || len(e) > maxFilterEntryLength {
+			return fmt.Errorf("filter %s must be between 1 and %d bytes long", name, maxFilterEntryLength)
+		}
+	}
+
+	return nil
+}
+
+func encodeReply(r controlReply) []byte {
+	data, err := json.Marshal(r)
+	if err != nil {
+		// controlReply is only ever strings
+		panic(err)
+	}
+
+	return data
+}
+
+func errorReply(err error) []byte {
+	return encodeReply(controlReply{Error: err.Error()})
+}
@@ -0,0 +1,118 @@
+package ws
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseControlMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"subscribe", `{"subscribe": {"types": ["message"], "channels": ["#ship"]}}`, ""},
+		{"ping", `{"ping": "hi"}`, ""},
+		{"resume", `{"resume": {"since": 12}}`, ""},
+		{"unknown type", `{"type": "message"}`, "invalid control message"},
+		{"unknown field alongside", `{"ping": "hi", "shout": true}`, "invalid control message"},
+		{"malformed", `{"ping": `, "invalid control message"},
+		{"not an object", `"ping"`, "invalid control message"},
+		{"trailing data", `{"ping": "hi"} {"ping": "again"}`, "trailing data"},
+		{"nothing set", `{}`, "exactly one"},
+		{"two set", `{"ping": "hi", "resume": {"since": 1}}`, "exactly one"},
+		{"long ping", `{"ping": "` + strings.Repeat("a", maxPingLength+1) + `"}`, "ping can be at most"},
+		{"empty filter entry", `{"subscribe": {"types": [""]}}`, "must be between"},
+		{"too many filter entries", `{"subscribe": {"channels": [` + strings.Repeat(`"a",`, maxFilterEntries) + `"a"]}}`, "at most"},
+	}
+
+	for _, test := range tests {
+		_, err := parseControlMessage([]byte(test.data))
+
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: got %v, want no error", test.name, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+// dialTestServer starts a Server and connects a websocket client to it.
+func dialTestServer(t *testing.T) *websocket.Conn {
+	s := NewServer("0", Options{ReplayCount: -1})
+	go s.hub.run()
+
+	ts := httptest.NewServer(s.mux)
+	t.Cleanup(ts.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestControlMessageReplies(t *testing.T) {
+	conn := dialTestServer(t)
+
+	tests := []struct {
+		name        string
+		messageType int
+		data        string
+		want        controlReply
+	}{
+		{"ping", websocket.TextMessage, `{"ping": "hi"}`, controlReply{Pong: stringPtr("hi")}},
+		{"malformed", websocket.TextMessage, `{"ping": `, controlReply{Error: "invalid control message: unexpected EOF"}},
+		{"unknown type", websocket.TextMessage, `{"type": "message"}`, controlReply{Error: `invalid control message: json: unknown field "type"`}},
+		{"binary", websocket.BinaryMessage, `{"ping": "hi"}`, controlReply{Error: "control messages must be text"}},
+	}
+
+	for _, test := range tests {
+		if err := conn.WriteMessage(test.messageType, []byte(test.data)); err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		want, _ := json.Marshal(test.want)
+		if string(data) != string(want) {
+			t.Errorf("%s: got %s, want %s", test.name, data, want)
+		}
+	}
+}
+
+func TestControlMessageTooBig(t *testing.T) {
+	conn := dialTestServer(t)
+
+	big := `{"ping": "` + strings.Repeat("a", maxMessageSize) + `"}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(big)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, data, err := conn.ReadMessage(); err == nil {
+		t.Errorf("got %s, want the connection closed", data)
+	} else if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("got %v, want closed for being too big", err)
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
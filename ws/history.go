@@ -0,0 +1,88 @@
+package ws
+
+// history is a ring buffer of the most recently broadcast activity. It's only
+// touched by the hub.
+type history struct {
+	messages []outbound
+
+	// index in messages the next message goes
+	next int
+
+	// whether messages has wrapped around yet
+	full bool
+}
+
+func newHistory(size int) *history {
+	return &history{
+		messages: make([]outbound, size),
+	}
+}
+
+func (h *history) add(message outbound) {
+	if len(h.messages) == 0 {
+		return
+	}
+
+	h.messages[h.next] = message
+
+	h.next++
+	if h.next == len(h.messages) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// all returns a copy of everything in the history, oldest first.
+func (h *history) all() []outbound {
+	if !h.full {
+		return append([]outbound{}, h.messages[:h.next]...)
+	}
+
+	return append(append([]outbound{}, h.messages[h.next:]...), h.messages[:h.next]...)
+}
+
+// oldest returns the sequence number of the oldest message in the history, or
+// false if it's empty.
+func (h *history) oldest() (uint64, bool) {
+	if h.full {
+		return h.messages[h.next].seq, true
+	}
+
+	if h.next == 0 {
+		return 0, false
+	}
+
+	return h.messages[0].seq, true
+}
+
+// since returns everything f matches in the history with a sequence number
+// after seq, oldest first.
+func (h *history) since(seq uint64, f Filter) []outbound {
+	matched := []outbound{}
+	for _, message := range h.all() {
+		if message.seq > seq && f.Matches(message.activity) {
+			matched = append(matched, message)
+		}
+	}
+
+	return matched
+}
+
+// last returns the n most recent messages that f matches, oldest first.
+func (h *history) last(n int, f Filter) []outbound {
+	all := h.all()
+
+	matched := []outbound{}
+	for i := len(all) - 1; i >= 0 && len(matched) < n; i-- {
+		if f.Matches(all[i].activity) {
+			matched = append(matched, all[i])
+		}
+	}
+
+	// matched is newest first
+	for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+		matched[i], matched[j] = matched[j], matched[i]
+	}
+
+	return matched
+}
@@ -1,9 +1,11 @@
 package ws
 
 import (
-	"bytes"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -19,20 +21,20 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum message size allowed from peer. Bigger messages close the
+	// connection.
+	maxMessageSize = 4096
 )
 
 var (
 	newline = []byte{'\n'}
-	space   = []byte{' '}
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
-		// TODO only allow hackclub.com
+		// serveWs has already checked the origin against Auth
 		return true
 	},
 }
@@ -43,22 +45,45 @@ type Hub struct {
 	// Registered clients.
 	clients map[*Client]bool
 
-	// Inbound messages from the clients.
-	broadcast chan []byte
+	// Activity to send to the clients that want it.
+	broadcast chan Activity
+
+	// Filter changes from the clients.
+	subscribe chan subscription
+
+	// Replies to control messages from the clients.
+	reply chan reply
+
+	// Requests from clients to be sent activity they missed.
+	resume chan resumption
 
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Sequence number of the last activity broadcast.
+	seq uint64
+
+	// Recently broadcast activity, for clients resuming where they left off.
+	history *history
+
+	// How much recent activity new clients get.
+	replayCount int
 }
 
-func newHub() *Hub {
+func newHub(historySize, replayCount int) *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+		broadcast:   make(chan Activity),
+		subscribe:   make(chan subscription),
+		reply:       make(chan reply),
+		resume:      make(chan resumption),
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		clients:     make(map[*Client]bool),
+		history:     newHistory(historySize),
+		replayCount: replayCount,
 	}
 }
 
@@ -67,42 +92,226 @@ func (h *Hub) run() {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
+
+			// backlog has room for exactly this, and the client always
+			// reads it before anything in send
+			client.backlog <- backlog{messages: h.backlogFor(client), through: h.seq}
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.send)
 			}
-		case message := <-h.broadcast:
+		case sub := <-h.subscribe:
+			if _, ok := h.clients[sub.client]; ok {
+				sub.client.filter = sub.filter
+			}
+		case r := <-h.reply:
+			if _, ok := h.clients[r.client]; ok {
+				h.deliver(r.client, outbound{data: r.data})
+			}
+		case r := <-h.resume:
+			if _, ok := h.clients[r.client]; !ok {
+				continue
+			}
+
+			select {
+			case r.client.backlog <- backlog{messages: h.resumeAfter(r.since, r.client.filter), through: h.seq}:
+			default:
+				h.deliver(r.client, outbound{data: errorReply(errors.New("already resuming"))})
+			}
+		case activity := <-h.broadcast:
+			h.seq++
+			activity.Seq = h.seq
+			if activity.ID == "" {
+				activity.ID = newActivityID()
+			}
+
+			encoded, err := encodeActivity(activity)
+			if err != nil {
+				log.Println("error encoding json for ws:", err)
+				continue
+			}
+
+			message := outbound{seq: activity.Seq, activity: activity, encoded: encoded}
+			h.history.add(message)
+
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
+				if client.filter.Matches(message.activity) {
+					h.deliver(client, message)
 				}
 			}
 		}
 	}
 }
 
-// Client is a middleman between the websocket connection and the hub.
+// backlogFor returns the activity a newly registered client should get before
+// anything new: what it missed if it's resuming, otherwise the most recent.
+func (h *Hub) backlogFor(client *Client) []outbound {
+	if client.resume {
+		return h.resumeAfter(client.resumeFrom, client.filter)
+	}
+
+	return h.recent(client.filter)
+}
+
+// resumeAfter returns everything f matches after seq. If some of it is gone,
+// it returns a reset notice followed by the most recent activity instead, so
+// the client knows to start over rather than quietly missing things.
+func (h *Hub) resumeAfter(seq uint64, f Filter) []outbound {
+	reason := ""
+
+	if seq > h.seq {
+		reason = "sequence number is from before a restart"
+	} else if seq < h.seq {
+		// the next one the client needs has to still be here
+		if oldest, ok := h.history.oldest(); !ok || oldest > seq+1 {
+			reason = "missed activity is no longer kept"
+		}
+	}
+
+	if reason == "" {
+		return h.history.since(seq, f)
+	}
+
+	// the seq is set so event streams pick it up as the last event ID
+	reset := outbound{
+		seq:  h.seq,
+		data: encodeReply(controlReply{Reset: &resetNotice{Seq: h.seq, Reason: reason}}),
+	}
+
+	return append([]outbound{reset}, h.recent(f)...)
+}
+
+// recent returns the most recent activity f matches, for clients that have
+// nothing yet.
+func (h *Hub) recent(f Filter) []outbound {
+	if h.replayCount < 0 {
+		return nil
+	}
+
+	return h.history.last(h.replayCount, f)
+}
+
+// deliver queues message for client, dropping the client if it's too far
+// behind. It reports whether the client is still connected.
+func (h *Hub) deliver(client *Client, message outbound) bool {
+	select {
+	case client.send <- message:
+		return true
+	default:
+		close(client.send)
+		delete(h.clients, client)
+		return false
+	}
+}
+
+// A backlog is activity a client missed, replayed to it all at once. It covers
+// everything up to sequence number through, so anything live the client was
+// sent up to then is already in it, if the client wants it at all.
+type backlog struct {
+	messages []outbound
+	through  uint64
+}
+
+// covers reports whether message is older than b and so was either replayed
+// in it or deliberately left out.
+func (b backlog) covers(message outbound) bool {
+	return message.seq != 0 && message.seq <= b.through
+}
+
+// outbound is a message on its way to clients, already encoded. Activity has
+// a sequence number and is encoded in every schema version, replies to control
+// messages don't and aren't.
+type outbound struct {
+	seq      uint64
+	activity Activity
+	encoded  map[int][]byte
+	data     []byte
+}
+
+// dataFor returns the message encoded for schema version.
+func (m outbound) dataFor(version int) []byte {
+	if m.encoded != nil {
+		return m.encoded[version]
+	}
+
+	return m.data
+}
+
+// Client is a middleman between a websocket connection or event stream and
+// the hub.
 type Client struct {
 	hub *Hub
 
-	// The websocket connection.
+	// The websocket connection. Nil for event stream clients.
 	conn *websocket.Conn
 
 	// Buffered channel of outbound messages.
-	send chan []byte
+	send chan outbound
+
+	// Activity sent before the client connected that it should get first.
+	// The hub sends exactly one backlog, possibly empty, on registration, and
+	// another whenever the client asks to resume.
+	backlog chan backlog
+
+	// Which activity the client wants. Only touched by the hub once the
+	// client is registered.
+	filter Filter
+
+	// If resume is set, the hub sends the client any activity it still has
+	// after sequence number resumeFrom when it registers. Otherwise it sends
+	// the most recent activity.
+	resume     bool
+	resumeFrom uint64
+
+	// The schema version to encode activity in.
+	version int
+}
+
+func newClient(hub *Hub, conn *websocket.Conn) *Client {
+	return &Client{
+		hub:     hub,
+		conn:    conn,
+		send:    make(chan outbound, 256),
+		backlog: make(chan backlog, 1),
+	}
+}
+
+// configure sets up the client's filter from the "types" and "channels" query
+// parameters, which are comma separated lists, its schema version from
+// "version", and has it resume after since if that's set.
+func (c *Client) configure(r *http.Request, since string) error {
+	c.version = parseSchemaVersion(r.URL.Query().Get("version"))
+
+	filter := Filter{
+		Types:    splitList(r.URL.Query().Get("types")),
+		Channels: splitList(r.URL.Query().Get("channels")),
+	}
+	if err := validateFilter(filter); err != nil {
+		return err
+	}
+
+	c.filter = filter.normalize()
+
+	if since != "" {
+		seq, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			return errors.New("invalid sequence number to resume from")
+		}
+
+		c.resume = true
+		c.resumeFrom = seq
+	}
+
+	return nil
 }
 
-// readPump pumps messages from the websocket connection to the hub.
+// readPump pumps control messages from the websocket connection to the hub.
+// Nothing a client sends is ever passed on to other clients.
 //
 // The application runs readPump in a per-connection goroutine. The application
 // ensures that there is at most one reader on a connection by executing all
 // reads from this goroutine.
-//
-// TODO: Remove
 func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister <- c
@@ -112,15 +321,33 @@ func (c *Client) readPump() {
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		_, message, err := c.conn.ReadMessage()
+		messageType, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("error: %v", err)
 			}
 			break
 		}
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.hub.broadcast <- message
+
+		if messageType != websocket.TextMessage {
+			c.hub.reply <- reply{client: c, data: errorReply(errors.New("control messages must be text"))}
+			continue
+		}
+
+		msg, err := parseControlMessage(message)
+		if err != nil {
+			c.hub.reply <- reply{client: c, data: errorReply(err)}
+			continue
+		}
+
+		switch {
+		case msg.Subscribe != nil:
+			c.hub.subscribe <- subscription{client: c, filter: msg.Subscribe.normalize()}
+		case msg.Ping != nil:
+			c.hub.reply <- reply{client: c, data: encodeReply(controlReply{Pong: msg.Ping})}
+		case msg.Resume != nil:
+			c.hub.resume <- resumption{client: c, since: msg.Resume.Since}
+		}
 	}
 }
 
@@ -135,8 +362,20 @@ func (c *Client) writePump() {
 		ticker.Stop()
 		c.conn.Close()
 	}()
+
+	// the backlog always comes first so it's in order with what follows
+	last := <-c.backlog
+	if !c.writeBacklog(last) {
+		return
+	}
+
 	for {
 		select {
+		case b := <-c.backlog:
+			if !c.writeBacklog(b) {
+				return
+			}
+			last = b
 		case message, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
@@ -145,21 +384,47 @@ func (c *Client) writePump() {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
 			// Add queued chat messages to the current websocket message.
+			messages := []outbound{message}
 			n := len(c.send)
 			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.send)
+				messages = append(messages, <-c.send)
 			}
 
-			if err := w.Close(); err != nil {
-				return
+			// a backlog the hub queued before any of these has to go out
+			// first, and then anything it covers mustn't go out again
+			select {
+			case b := <-c.backlog:
+				if !c.writeBacklog(b) {
+					return
+				}
+				last = b
+			default:
+			}
+
+			var w io.WriteCloser
+			for _, message := range messages {
+				if last.covers(message) {
+					continue
+				}
+
+				if w == nil {
+					var err error
+					w, err = c.conn.NextWriter(websocket.TextMessage)
+					if err != nil {
+						return
+					}
+				} else {
+					w.Write(newline)
+				}
+
+				w.Write(message.dataFor(c.version))
+			}
+
+			if w != nil {
+				if err := w.Close(); err != nil {
+					return
+				}
 			}
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
@@ -170,14 +435,43 @@ func (c *Client) writePump() {
 	}
 }
 
+func (c *Client) writeBacklog(b backlog) bool {
+	for _, message := range b.messages {
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.conn.WriteMessage(websocket.TextMessage, message.dataFor(c.version)); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
 // serveWs handles websocket requests from the peer.
-func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+func serveWs(hub *Hub, auth Auth, w http.ResponseWriter, r *http.Request) {
+	protocol, status, err := auth.check(r)
+	if err != nil {
+		log.Printf("rejecting websocket connection from %s (origin %q): %v", r.RemoteAddr, r.Header.Get("Origin"), err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	var responseHeader http.Header
+	if protocol != "" {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {protocol}}
+	}
+
+	client := newClient(hub, nil)
+	if err := client.configure(r, r.URL.Query().Get("since")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
+	client.conn = conn
 	client.hub.register <- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
@@ -0,0 +1,146 @@
+package ws
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestHub makes a hub that's had n activities broadcast to it, without
+// running it.
+func newTestHub(historySize, n int) *Hub {
+	h := newHub(historySize, 2)
+	for i := 0; i < n; i++ {
+		h.seq++
+		h.history.add(outbound{seq: h.seq, activity: Activity{Seq: h.seq, Type: "message"}})
+	}
+
+	return h
+}
+
+func TestResumeAfter(t *testing.T) {
+	tests := []struct {
+		name        string
+		historySize int
+		broadcast   int
+		since       uint64
+		wantReset   bool
+		wantSeqs    []uint64
+	}{
+		{"caught up", 5, 3, 3, false, nil},
+		{"missed some", 5, 3, 1, false, []uint64{2, 3}},
+		{"missed everything kept", 5, 8, 3, false, []uint64{4, 5, 6, 7, 8}},
+		{"missed more than kept", 5, 8, 2, true, []uint64{7, 8}},
+		{"from before a restart", 5, 3, 100, true, []uint64{2, 3}},
+		{"nothing kept", 0, 3, 1, true, nil},
+		{"nothing yet", 5, 0, 0, false, nil},
+	}
+
+	for _, test := range tests {
+		h := newTestHub(test.historySize, test.broadcast)
+		backlog := h.resumeAfter(test.since, Filter{})
+
+		reset := len(backlog) > 0 && backlog[0].data != nil
+		if reset != test.wantReset {
+			t.Errorf("%s: reset = %v, want %v", test.name, reset, test.wantReset)
+			continue
+		}
+
+		if reset {
+			var r controlReply
+			if err := json.Unmarshal(backlog[0].data, &r); err != nil || r.Reset == nil || r.Reset.Seq != h.seq {
+				t.Errorf("%s: reset notice %s, want one at seq %d", test.name, backlog[0].data, h.seq)
+			}
+			backlog = backlog[1:]
+		}
+
+		seqs := []uint64{}
+		for _, message := range backlog {
+			seqs = append(seqs, message.seq)
+		}
+
+		if len(seqs) != len(test.wantSeqs) {
+			t.Errorf("%s: got %v, want %v", test.name, seqs, test.wantSeqs)
+			continue
+		}
+		for i := range seqs {
+			if seqs[i] != test.wantSeqs[i] {
+				t.Errorf("%s: got %v, want %v", test.name, seqs, test.wantSeqs)
+				break
+			}
+		}
+	}
+}
+
+func TestNegativeHistorySize(t *testing.T) {
+	s := NewServer("0", Options{HistorySize: -1})
+	s.hub.history.add(outbound{seq: 1})
+
+	if all := s.hub.history.all(); len(all) != 0 {
+		t.Errorf("kept %d messages, want none", len(all))
+	}
+}
+
+func TestWritePumpKeepsBacklogInOrder(t *testing.T) {
+	message := func(seq uint64) outbound {
+		return outbound{seq: seq, encoded: map[int][]byte{1: []byte(`{"seq":` + strconv.FormatUint(seq, 10) + `}`)}}
+	}
+
+	c := newClient(newHub(10, 0), nil)
+	c.version = 1
+
+	// what the hub would queue for a client that's sent 5 and 6 live, asks to
+	// resume from the start, and then gets 7 live
+	c.backlog <- backlog{through: 4}
+	c.send <- message(5)
+	c.send <- message(6)
+	go func() {
+		c.backlog <- backlog{messages: []outbound{message(1), message(2), message(3), message(4), message(5), message(6)}, through: 6}
+		c.send <- message(7)
+	}()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		c.conn = conn
+		go c.writePump()
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var seqs []uint64
+	for len(seqs) == 0 || seqs[len(seqs)-1] < 7 {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("got %v, then %v", seqs, err)
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			var a struct{ Seq uint64 }
+			json.Unmarshal([]byte(line), &a)
+			seqs = append(seqs, a.Seq)
+		}
+	}
+
+	for i, seq := range seqs {
+		if seq != uint64(i+1) {
+			t.Fatalf("got %v, want 1 to 7 in order", seqs)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package ws
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hackclub/streambot/geo"
+)
+
+// Schema versions clients can ask for with the "version" query parameter.
+// Clients that don't ask, or ask for a version we don't have, get version 1,
+// so old clients keep working.
+//
+// Version 1 is the original format: locations are latitude and longitude
+// strings, eg. "from": ["37.7749", "-122.4194"], and fields are left out or
+// null when there's nothing to put in them.
+//
+// Version 2 has typed coordinates, eg. "from": {"lat": 37.7749, "lon":
+// -122.4194}, and every field is always present. Those that can be empty are
+// null rather than missing, except "to" which is always a list.
+const (
+	SchemaVersion        = 2
+	defaultSchemaVersion = 1
+)
+
+// The JSON Schema documents for each version, served at /schema/v<n>.json.
+var schemas = map[int]string{
+	1: schemaV1,
+	2: schemaV2,
+}
+
+type activityV1 struct {
+	ID             string     `json:"id"`
+	Seq            uint64     `json:"seq"`
+	Version        int        `json:"version"`
+	Type           string     `json:"type"`
+	ChannelName    string     `json:"channel,omitempty"`
+	Reaction       string     `json:"reaction,omitempty"`
+	Timestamp      time.Time  `json:"timestamp"`
+	SlackTimestamp string     `json:"slack_ts,omitempty"`
+	From           []string   `json:"from"`
+	To             [][]string `json:"to"`
+}
+
+type activityV2 struct {
+	ID             string         `json:"id"`
+	Seq            uint64         `json:"seq"`
+	Version        int            `json:"version"`
+	Type           string         `json:"type"`
+	ChannelName    *string        `json:"channel"`
+	Reaction       *string        `json:"reaction"`
+	Timestamp      time.Time      `json:"timestamp"`
+	SlackTimestamp *string        `json:"slack_ts"`
+	From           *geo.GeoPoint  `json:"from"`
+	To             []geo.GeoPoint `json:"to"`
+}
+
+// encodeActivity encodes a in every schema version, indexed by version.
+func encodeActivity(a Activity) (map[int][]byte, error) {
+	var fromV1 []string
+	if a.From != nil {
+		fromV1 = a.From.Strings()
+	}
+
+	var toV1 [][]string
+	if a.To != nil {
+		toV1 = [][]string{}
+		for _, p := range a.To {
+			toV1 = append(toV1, p.Strings())
+		}
+	}
+
+	v1, err := json.Marshal(activityV1{
+		ID:             a.ID,
+		Seq:            a.Seq,
+		Version:        1,
+		Type:           a.Type,
+		ChannelName:    a.ChannelName,
+		Reaction:       a.Reaction,
+		Timestamp:      a.Timestamp,
+		SlackTimestamp: a.SlackTimestamp,
+		From:           fromV1,
+		To:             toV1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	to := a.To
+	if to == nil {
+		to = []geo.GeoPoint{}
+	}
+
+	v2, err := json.Marshal(activityV2{
+		ID:             a.ID,
+		Seq:            a.Seq,
+		Version:        2,
+		Type:           a.Type,
+		ChannelName:    nullable(a.ChannelName),
+		Reaction:       nullable(a.Reaction),
+		Timestamp:      a.Timestamp,
+		SlackTimestamp: nullable(a.SlackTimestamp),
+		From:           a.From,
+		To:             to,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[int][]byte{1: v1, 2: v2}, nil
+}
+
+func nullable(s string) *string {
+	if s == "" {
+		return nil
+	}
+
+	return &s
+}
+
+// parseSchemaVersion reads the version a client asked for, or the default if
+// it didn't ask for one we have.
+func parseSchemaVersion(s string) int {
+	version, err := strconv.Atoi(s)
+	if err != nil || schemas[version] == "" {
+		return defaultSchemaVersion
+	}
+
+	return version
+}
+
+// serveSchema serves the JSON Schema for each version, eg. /schema/v2.json.
+func serveSchema(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/schema/")
+	if !strings.HasPrefix(name, "v") || !strings.HasSuffix(name, ".json") {
+		http.NotFound(w, r)
+		return
+	}
+
+	version, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "v"), ".json"))
+	if err != nil || schemas[version] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write([]byte(schemas[version]))
+}
+
+const schemaV1 = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "/schema/v1.json",
+  "title": "streambot activity, version 1",
+  "type": "object",
+  "required": ["id", "seq", "version", "type", "timestamp", "from", "to"],
+  "properties": {
+    "id": {"type": "string", "description": "Unique ID of the activity."},
+    "seq": {"type": "integer", "minimum": 1, "description": "Increases by one for each activity. Resets when streambot restarts."},
+    "version": {"const": 1},
+    "type": {"type": "string", "description": "Slack event type, eg. message, user_typing or reaction_added."},
+    "channel": {"type": "string", "description": "Channel name starting with #. Missing if the activity isn't in a channel."},
+    "reaction": {"type": "string", "description": "Emoji name for reaction_added. Missing otherwise."},
+    "timestamp": {"type": "string", "format": "date-time", "description": "When the activity happened."},
+    "slack_ts": {"type": "string", "description": "Slack's timestamp for the event. Missing if it didn't have one."},
+    "from": {
+      "description": "Where the user is, as latitude and longitude strings, or null if unknown.",
+      "oneOf": [
+        {"type": "null"},
+        {"type": "array", "items": {"type": "string"}}
+      ]
+    },
+    "to": {
+      "description": "Where everyone active in the channel is, or null if nobody.",
+      "oneOf": [
+        {"type": "null"},
+        {"type": "array", "items": {"type": "array", "items": {"type": "string"}}}
+      ]
+    }
+  }
+}
+`
+
+const schemaV2 = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "/schema/v2.json",
+  "title": "streambot activity, version 2",
+  "type": "object",
+  "required": ["id", "seq", "version", "type", "channel", "reaction", "timestamp", "slack_ts", "from", "to"],
+  "additionalProperties": false,
+  "definitions": {
+    "coordinates": {
+      "type": "object",
+      "required": ["lat", "lon"],
+      "additionalProperties": false,
+      "properties": {
+        "lat": {"type": "number", "minimum": -90, "maximum": 90},
+        "lon": {"type": "number", "minimum": -180, "maximum": 180}
+      }
+    }
+  },
+  "properties": {
+    "id": {"type": "string", "description": "Unique ID of the activity."},
+    "seq": {"type": "integer", "minimum": 1, "description": "Increases by one for each activity. Resets when streambot restarts."},
+    "version": {"const": 2},
+    "type": {"type": "string", "description": "Slack event type, eg. message, user_typing or reaction_added."},
+    "channel": {"type": ["string", "null"], "description": "Channel name starting with #, or null if the activity isn't in a channel."},
+    "reaction": {"type": ["string", "null"], "description": "Emoji name for reaction_added, null otherwise."},
+    "timestamp": {"type": "string", "format": "date-time", "description": "When the activity happened."},
+    "slack_ts": {"type": ["string", "null"], "description": "Slack's timestamp for the event, or null if it didn't have one."},
+    "from": {
+      "description": "Where the user is, or null if unknown.",
+      "oneOf": [
+        {"type": "null"},
+        {"$ref": "#/definitions/coordinates"}
+      ]
+    },
+    "to": {
+      "description": "Where everyone active in the channel is. Empty if nobody.",
+      "type": "array",
+      "items": {"$ref": "#/definitions/coordinates"}
+    }
+  }
+}
+`
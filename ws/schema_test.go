@@ -0,0 +1,92 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hackclub/streambot/geo"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files with the current output")
+
+func TestEncodeActivityGolden(t *testing.T) {
+	at := time.Date(2020, 5, 19, 17, 40, 0, 200000000, time.UTC)
+
+	activities := map[string]Activity{
+		"full": {
+			ID:             "abc123",
+			Seq:            7,
+			Type:           "reaction_added",
+			ChannelName:    "#ship",
+			Reaction:       "tada",
+			Timestamp:      at,
+			SlackTimestamp: "1589910000.000200",
+			From:           &geo.GeoPoint{Lat: 37.7749, Lon: -122.4194},
+			To:             []geo.GeoPoint{{Lat: 51.5074, Lon: -0.1278}, {Lat: -33.8688, Lon: 151.2093}},
+		},
+		"empty": {
+			ID:        "def456",
+			Seq:       8,
+			Type:      "user_typing",
+			Timestamp: at,
+		},
+	}
+
+	for name, activity := range activities {
+		encoded, err := encodeActivity(activity)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for version := 1; version <= SchemaVersion; version++ {
+			var got bytes.Buffer
+			json.Indent(&got, encoded[version], "", "  ")
+			got.WriteString("\n")
+
+			golden := filepath.Join("testdata", name+"_v"+strconv.Itoa(version)+".json")
+
+			if *update {
+				if err := ioutil.WriteFile(golden, got.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("%s in v%d is\n%s\nwant\n%s", name, version, got.Bytes(), want)
+			}
+		}
+	}
+}
+
+func TestParseSchemaVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 1},
+		{"1", 1},
+		{"2", 2},
+		{"3", 1},
+		{"0", 1},
+		{"-1", 1},
+		{"two", 1},
+	}
+
+	for _, test := range tests {
+		if got := parseSchemaVersion(test.in); got != test.want {
+			t.Errorf("parseSchemaVersion(%q) = %d, want %d", test.in, got, test.want)
+		}
+	}
+}
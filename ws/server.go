@@ -1,20 +1,44 @@
 package ws
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
+
+	"github.com/hackclub/streambot/geo"
 )
 
+// Activity is something that happened in Slack, on its way to clients. How
+// it's encoded for them depends on the schema version they asked for, see
+// schema.go.
 type Activity struct {
-	Type        string     `json:"type"`
-	ChannelName string     `json:"channel,omitempty"`
-	Reaction    string     `json:"reaction,omitempty"`
-	Timestamp   time.Time  `json:"timestamp"`
-	From        []string   `json:"from"`
-	To          [][]string `json:"to"`
+	// ID uniquely identifies the activity, even across restarts, so clients
+	// can deduplicate and refer to it.
+	ID string
+
+	// Seq increases by one for each activity broadcast. Clients can use it to
+	// resume where they left off and to notice anything they missed.
+	Seq uint64
+
+	Type        string
+	ChannelName string
+	Reaction    string
+
+	// Timestamp is when the activity happened in Slack if it says, otherwise
+	// when we heard about it.
+	Timestamp time.Time
+
+	// SlackTimestamp is Slack's own timestamp for the event, eg.
+	// "1589910000.000200", if it has one.
+	SlackTimestamp string
+
+	// From is where the user is, if we know. To is where everyone active in
+	// the channel is.
+	From *geo.GeoPoint
+	To   []geo.GeoPoint
 }
 
 func NewActivity(activityType, channel string) Activity {
@@ -25,41 +49,91 @@ func NewActivity(activityType, channel string) Activity {
 	}
 }
 
+// newActivityID makes a random ID for an activity.
+func newActivityID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails if the OS can't give us randomness at all
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+const (
+	DefaultHistorySize = 1000
+	DefaultReplayCount = 50
+)
+
+// Options configures a Server.
+type Options struct {
+	Auth Auth
+
+	// HistorySize is how much recent activity is kept for clients resuming
+	// where they left off. Defaults to DefaultHistorySize. Negative means
+	// none, so clients can't resume.
+	HistorySize int
+
+	// ReplayCount is how much recent activity clients get when they first
+	// connect, so they have something to show straight away. Defaults to
+	// DefaultReplayCount. Negative means none.
+	ReplayCount int
+}
+
 type Server struct {
 	hub  *Hub
+	mux  *http.ServeMux
 	port string
+	auth Auth
 }
 
-func NewServer(port string) *Server {
+func NewServer(port string, opts Options) *Server {
+	if opts.HistorySize == 0 {
+		opts.HistorySize = DefaultHistorySize
+	}
+	if opts.HistorySize < 0 {
+		opts.HistorySize = 0
+	}
+	if opts.ReplayCount == 0 {
+		opts.ReplayCount = DefaultReplayCount
+	}
+
 	s := Server{}
 
-	s.hub = newHub()
+	s.hub = newHub(opts.HistorySize, opts.ReplayCount)
+	s.mux = http.NewServeMux()
 	s.port = port
+	s.auth = opts.Auth
+
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		serveWs(s.hub, s.auth, w, r)
+	})
+	s.mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		serveSSE(s.hub, s.auth, w, r)
+	})
+	s.mux.HandleFunc("/schema/", serveSchema)
 
 	return &s
 }
 
+// Handle registers an extra HTTP handler to be served alongside the
+// websocket, on the same port.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
 func (s *Server) Serve() {
 	go s.hub.run()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(s.hub, w, r)
-	})
-
 	fmt.Println("websocket server listening on :" + s.port)
-	err := http.ListenAndServe(":"+s.port, nil)
+	err := http.ListenAndServe(":"+s.port, s.mux)
 	if err != nil {
 		log.Fatal("error hosting websocket server: ", err)
 	}
 }
 
-func (s *Server) Broadcast(obj interface{}) {
-	toSend, err := json.Marshal(obj)
-	if err != nil {
-		fmt.Println("error encoding json for ws:", err)
-		return
-	}
-
+// Broadcast sends activity to every client whose filter matches it.
+func (s *Server) Broadcast(activity Activity) {
 	fmt.Println("broadcasting msg type to ws...")
-	s.hub.broadcast <- toSend
+	s.hub.broadcast <- activity
 }
@@ -0,0 +1,118 @@
+package ws
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often to send a comment down idle event streams so proxies don't time
+// them out.
+const sseHeartbeatPeriod = 15 * time.Second
+
+// serveSSE streams activity as Server-Sent Events, for clients that can't use
+// websockets. Each event's data is the same JSON websocket clients get and its
+// ID is the activity's sequence number, so a reconnecting client's
+// Last-Event-ID picks up where it left off.
+//
+// Filters are given in the query string as comma separated lists, eg.
+// /events?types=message,reaction_added&channels=ship. Clients that can't set
+// Last-Event-ID can pass the sequence number to resume after as "since", and
+// the schema version is picked with "version" like for websockets.
+func serveSSE(hub *Hub, auth Auth, w http.ResponseWriter, r *http.Request) {
+	if _, status, err := auth.check(r); err != nil {
+		log.Printf("rejecting event stream from %s (origin %q): %v", r.RemoteAddr, r.Header.Get("Origin"), err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+
+	client := newClient(hub, nil)
+	if err := client.configure(r, since); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	hub.register <- client
+	defer func() {
+		hub.unregister <- client
+	}()
+
+	for _, message := range (<-client.backlog).messages {
+		writeSSE(w, message, client.version)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatPeriod)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				// The hub dropped us for falling behind.
+				return
+			}
+
+			writeSSE(w, message, client.version)
+
+			// Add queued messages to the same write.
+			n := len(client.send)
+			for i := 0; i < n; i++ {
+				writeSSE(w, <-client.send, client.version)
+			}
+
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, message outbound, version int) {
+	if message.seq != 0 {
+		w.Write([]byte("id: " + strconv.FormatUint(message.seq, 10) + "\n"))
+	}
+
+	w.Write([]byte("data: "))
+	w.Write(message.dataFor(version))
+	w.Write([]byte("\n\n"))
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
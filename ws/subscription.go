@@ -0,0 +1,52 @@
+package ws
+
+import (
+	"strings"
+)
+
+// A Filter picks which activity a client wants. Empty lists match everything.
+type Filter struct {
+	Types    []string `json:"types"`
+	Channels []string `json:"channels"`
+}
+
+// normalize makes channel names all start with "#", like Activity.ChannelName.
+func (f Filter) normalize() Filter {
+	channels := make([]string, 0, len(f.Channels))
+	for _, channel := range f.Channels {
+		if !strings.HasPrefix(channel, "#") {
+			channel = "#" + channel
+		}
+
+		channels = append(channels, channel)
+	}
+
+	f.Channels = channels
+
+	return f
+}
+
+// Matches reports whether a passes the filter.
+func (f Filter) Matches(a Activity) bool {
+	return matchesAny(f.Types, a.Type) && matchesAny(f.Channels, a.ChannelName)
+}
+
+func matchesAny(allowed []string, s string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, a := range allowed {
+		if a == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A subscription is a request from a client to change its filter.
+type subscription struct {
+	client *Client
+	filter Filter
+}